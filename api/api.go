@@ -6,25 +6,150 @@ import (
 
 const (
 	HttpV1SubmitEvent = "/submit/event"
+	HttpV1SubmitJob   = "/submit/job"
 	HttpV1Stat        = "/stat"
 
-	HttpV1CNCShutdown = "/cnc/shutdown"
+	HttpV1CNCShutdown        = "/cnc/shutdown"
+	HttpV1CNCDeadLetter      = "/cnc/deadletter"
+	HttpV1CNCDeadLetterRetry = "/cnc/deadletter/retry"
+	HttpV1CNCDeadLetterPurge = "/cnc/deadletter/purge"
+	HttpV1CNCActions         = "/cnc/actions"
+	HttpV1CNCReloadActions   = "/cnc/actions/reload"
+	HttpV1CNCActionOutput    = "/cnc/actions/output"
+	HttpV1CNCEvents          = "/cnc/events"
+	HttpV1CNCEventsReplay    = "/cnc/events/replay"
 )
 
+// Given with every attempt at the same submission, so that the
+// server handles the submission once however many times it is made
+const IdempotencyKeyHeader = "idempotency-key"
+
 type Options struct {
 	Binding     string
 	AssetId     string
 	AccessToken string
+
+	// Times a submission is made again when the server can't be reached or
+	// can't take it yet, waiting RetryDelay (doubling each time) in between,
+	// or as long as the server asks. Retried submissions carry an idempotency
+	// key so that they are handled once
+	Retries    int
+	RetryDelay time.Duration
+
+	// Content type of the data submitted, ex: application/json
+	// (application/octet-stream if not given). With Gzip the
+	// data is compressed before it is sent
+	ContentType string
+	Gzip        bool
 }
 
+const DefaultRetryDelay = 500 * time.Millisecond
+
+const DefaultContentType = "application/octet-stream"
+
 type CNCApi interface {
 	Shutdown() error
+
+	// Dead letter operations take the id of a job, or
+	// an empty string to operate on every dead letter
+	DeadLetters() ([]DeadLetter, error)
+	RetryDeadLetters(id string) (int, error)
+	PurgeDeadLetters(id string) (int, error)
+
+	// Reload changed actions, returning the names of those reloaded
+	ReloadActions() ([]string, error)
+
+	// The names of the actions currently loaded
+	Actions() ([]string, error)
+
+	// Recent output of an action, limited to the lines
+	// numbered after `after` (0 for everything kept)
+	ActionOutput(action string, after int64) ([]OutputLine, error)
+
+	// The history of accepted events, oldest first
+	Events(query EventQuery) ([]EventRecord, error)
+
+	// Submit the events matching the query again, through the actions
+	// currently loaded. If a route is given the events are sent there
+	// rather than to the route they were submitted to
+	ReplayEvents(query EventQuery, route string) (ReplayResult, error)
 }
 
 type SubmissionApi interface {
-	Submit(route string, data []byte) error
+	Submit(route string, data []byte) (string, error)
+	SubmitTagged(route string, tags []string, data []byte) (string, error)
+	JobStatus(id string) (JobStatus, error)
+}
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+type JobStatus struct {
+	Id    string `json:"id"`
+	State string `json:"state"`
+	Error string `json:"error"`
 }
 
 type StatsApi interface {
 	GetUptime() (time.Duration, error)
+	GetStats() (StatsResponse, error)
+}
+
+// A job that failed every attempt it was given
+type DeadLetter struct {
+	Id       string    `json:"id"`
+	Origin   string    `json:"origin"`
+	Route    string    `json:"route"`
+	Data     []byte    `json:"data"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed"`
+}
+
+// A line written by an action to stdout, stderr or emrs.Log
+type OutputLine struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+const (
+	EventPending   = "pending"
+	EventSucceeded = "succeeded"
+	EventFailed    = "failed"
+)
+
+// An event accepted from an asset, and what became of it
+type EventRecord struct {
+	Id       string    `json:"id"`
+	Origin   string    `json:"origin"`
+	Route    string    `json:"route"`
+	Size     int       `json:"size"`
+	Payload  []byte    `json:"payload"` // As much of the data as the server kept
+	Received time.Time `json:"received"`
+	Jobs     int       `json:"jobs"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error"`
+}
+
+// Limits the events retrieved to those matching every field that is set
+type EventQuery struct {
+	Asset  string    // Id of the submitting asset
+	Route  string    // The route, or routes beginning with it
+	Since  time.Time
+	Until  time.Time
+	Status string    // EventPending, EventSucceeded or EventFailed
+	Limit  int       // Only the most recent, if not zero
+}
+
+// What became of a replay. Events are skipped if their data wasn't kept
+type ReplayResult struct {
+	Replayed int      `json:"replayed"`
+	Skipped  int      `json:"skipped"`
+	Jobs     []string `json:"jobs"`
 }
@@ -1,7 +1,11 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func HttpCNC(binding string, uiKey string, info *HttpsInfo) CNCApi {
@@ -17,28 +21,285 @@ func HttpCNC(binding string, uiKey string, info *HttpsInfo) CNCApi {
 
 func (c *httpController) Shutdown() error {
 
+	request, err := c.buildCncPostRequest(HttpV1CNCShutdown, "")
+	if err != nil {
+		return err
+	}
+
+	client := newHttpClient(c.https)
+
+	result, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	if result.StatusCode != http.StatusOK {
+		return ErrUnexpectedStatusCode
+	}
+	return nil
+}
+
+func (c *httpController) DeadLetters() ([]DeadLetter, error) {
+
+	letters := make([]DeadLetter, 0)
+
+	opts, err := c.cncOptions()
+	if err != nil {
+		return letters, err
+	}
+
+	request, err := buildHttpGetRequest(HttpV1CNCDeadLetter, opts)
+	if err != nil {
+		return letters, err
+	}
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return letters, err
+	}
+
+	if err := json.Unmarshal(body, &letters); err != nil {
+		return letters, err
+	}
+	return letters, nil
+}
+
+func (c *httpController) RetryDeadLetters(id string) (int, error) {
+
+	request, err := c.buildCncPostRequest(HttpV1CNCDeadLetterRetry, id)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Retried int `json:"retried"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, err
+	}
+	return result.Retried, nil
+}
+
+func (c *httpController) PurgeDeadLetters(id string) (int, error) {
+
+	request, err := c.buildCncPostRequest(HttpV1CNCDeadLetterPurge, id)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, err
+	}
+	return result.Purged, nil
+}
+
+func (c *httpController) ReloadActions() ([]string, error) {
+
+	request, err := c.buildCncPostRequest(HttpV1CNCReloadActions, "")
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Reloaded []string `json:"reloaded"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return result.Reloaded, nil
+}
+
+func (c *httpController) Actions() ([]string, error) {
+
+	opts, err := c.cncOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := buildHttpGetRequest(HttpV1CNCActions, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Loaded []string `json:"loaded"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return result.Loaded, nil
+}
+
+func (c *httpController) ActionOutput(action string, after int64) ([]OutputLine, error) {
+
+	lines := make([]OutputLine, 0)
+
+	opts, err := c.cncOptions()
+	if err != nil {
+		return lines, err
+	}
+
+	request, err := buildHttpGetRequest(HttpV1CNCActionOutput, opts)
+	if err != nil {
+		return lines, err
+	}
+	request.Header.Add("action", action)
+	request.Header.Add("after", strconv.FormatInt(after, 10))
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return lines, err
+	}
+
+	if err := json.Unmarshal(body, &lines); err != nil {
+		return lines, err
+	}
+	return lines, nil
+}
+
+func (c *httpController) Events(query EventQuery) ([]EventRecord, error) {
+
+	events := make([]EventRecord, 0)
+
+	opts, err := c.cncOptions()
+	if err != nil {
+		return events, err
+	}
+
+	request, err := buildHttpGetRequest(HttpV1CNCEvents, opts)
+	if err != nil {
+		return events, err
+	}
+	addEventQueryHeaders(request, query)
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return events, err
+	}
+
+	if err := json.Unmarshal(body, &events); err != nil {
+		return events, err
+	}
+	return events, nil
+}
+
+func (c *httpController) ReplayEvents(query EventQuery, route string) (ReplayResult, error) {
+
+	result := ReplayResult{}
+
+	request, err := c.buildCncPostRequest(HttpV1CNCEventsReplay, "")
+	if err != nil {
+		return result, err
+	}
+	addEventQueryHeaders(request, query)
+	if route != "" {
+		request.Header.Add("to", route)
+	}
+
+	body, err := c.doCncRequest(request)
+	if err != nil {
+		return result, err
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func addEventQueryHeaders(request *http.Request, query EventQuery) {
+	if query.Asset != "" {
+		request.Header.Add("asset", query.Asset)
+	}
+	if query.Route != "" {
+		request.Header.Add("route", query.Route)
+	}
+	if !query.Since.IsZero() {
+		request.Header.Add("since", query.Since.Format(time.RFC3339Nano))
+	}
+	if !query.Until.IsZero() {
+		request.Header.Add("until", query.Until.Format(time.RFC3339Nano))
+	}
+	if query.Status != "" {
+		request.Header.Add("status", query.Status)
+	}
+	if query.Limit > 0 {
+		request.Header.Add("limit", strconv.Itoa(query.Limit))
+	}
+}
+
+// CNC requests are made directly against the server's binding,
+// so the binding needs to be turned into a URL first
+func (c *httpController) cncOptions() (Options, error) {
 	opts := c.opts
 
 	binding, err := formUrlFromBinding(c.opts.Binding, c.https != nil)
 	if err != nil {
-		return err
+		return opts, err
 	}
 	opts.Binding = binding
+	return opts, nil
+}
 
-	request, err := buildHttpPostRequest("/cnc/shutdown", "", []byte{}, opts)
+// Build a POST to a CNC endpoint. If a job is given
+// it is passed along in the `job` header
+func (c *httpController) buildCncPostRequest(endpoint string, job string) (*http.Request, error) {
+
+	opts, err := c.cncOptions()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	request, err := buildHttpPostRequest(endpoint, "", []byte{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if job != "" {
+		request.Header.Add("job", job)
+	}
+	return request, nil
+}
+
+func (c *httpController) doCncRequest(request *http.Request) ([]byte, error) {
+
 	client := newHttpClient(c.https)
 
 	result, err := client.Do(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	defer result.Body.Close()
+
 	if result.StatusCode != http.StatusOK {
-		return ErrUnexpectedStatusCode
+		return nil, ErrUnexpectedStatusCode
 	}
-	return nil
+
+	body := new(bytes.Buffer)
+	body.ReadFrom(result.Body)
+	return body.Bytes(), nil
 }
@@ -9,6 +9,7 @@ import (
 )
 
 var ErrMalformedRoute = errors.New("invalid route")
+var ErrMalformedTags = errors.New("invalid tags")
 
 // UUIDs and the chunks that compose an action route (chunk.chunk.chunk)
 // all follow the same naming convention: alphanum, with any `-` or `_`
@@ -68,3 +69,36 @@ func ComposeRoute(route []string) (string, error) {
 	}
 	return result, nil
 }
+
+// Transform a ',' encoded list of tags (as sent in the `tags` header)
+// into a string list, validating each tag as a common chunk. An empty
+// string is no tags. Returns ErrMalformedTags if any tag is invalid
+func DecomposeTags(tags string) ([]string, error) {
+
+	if strings.TrimSpace(tags) == "" {
+		return []string{}, nil
+	}
+
+	result := strings.Split(tags, ",")
+	for i, v := range result {
+		v = strings.TrimSpace(v)
+		if !ValidateCommonChunk(v) {
+			slog.Error("invalid tag", "tag", i)
+			return result, ErrMalformedTags
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// Transform a list of tags into the ',' encoded form sent in the
+// `tags` header. Returns ErrMalformedTags if any tag is invalid
+func ComposeTags(tags []string) (string, error) {
+	for i, v := range tags {
+		if !ValidateCommonChunk(v) {
+			slog.Error("invalid tag", "tag", i)
+			return "", ErrMalformedTags
+		}
+	}
+	return strings.Join(tags, ","), nil
+}
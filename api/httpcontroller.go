@@ -19,6 +19,7 @@ const (
 )
 
 var ErrUnexpectedStatusCode = errors.New("received unexpected status code")
+var ErrTooManyRequests = errors.New("submission rate limit exceeded")
 
 type HttpsInfo struct {
 	Cert string
@@ -45,16 +46,38 @@ func buildHttpPostRequest(endpoint string, route string, data []byte, opt Option
 		return nil, err
 	}
 
+	contentType := opt.ContentType
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+
 	r, err := http.NewRequest("POST", dest, bytes.NewBuffer(data))
-	r.Header.Add("Content-Type", "octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Add("Content-Type", contentType)
 	r.Header.Add("EMRS-API-Version", HttpApiVersion)
 	r.Header.Add("origin", opt.AssetId)
 	r.Header.Add("token", opt.AccessToken)
 	r.Header.Add("route", route)
+	return r, nil
+}
+
+func buildHttpGetRequest(endpoint string, opt Options) (*http.Request, error) {
+	slog.Debug("build get request", "binding", opt.Binding, "asset", opt.AssetId)
 
+	dest, err := url.JoinPath(opt.Binding, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequest("GET", dest, nil)
 	if err != nil {
 		return nil, err
 	}
+	r.Header.Add("EMRS-API-Version", HttpApiVersion)
+	r.Header.Add("origin", opt.AssetId)
+	r.Header.Add("token", opt.AccessToken)
 	return r, nil
 }
 
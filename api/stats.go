@@ -8,7 +8,8 @@ import (
 )
 
 type StatsResponse struct {
-	Uptime time.Duration `json:uptime`
+	Uptime    time.Duration `json:uptime`
+	Throttled uint64        `json:"throttled"` // Submissions refused for exceeding a rate limit
 }
 
 func HttpStats(opts Options, info *HttpsInfo) StatsApi {
@@ -18,19 +19,25 @@ func HttpStats(opts Options, info *HttpsInfo) StatsApi {
 // Retrieve the duration of time a remote server has been running
 // If the server can not be reached, an error can be expected
 func (c *httpController) GetUptime() (time.Duration, error) {
+	stats, err := c.GetStats()
+	return stats.Uptime, err
+}
+
+// Retrieve everything a remote server reports of itself
+func (c *httpController) GetStats() (StatsResponse, error) {
 
-	var t time.Duration
+	var result StatsResponse
 
 	dest, err := url.JoinPath(c.opts.Binding, "/stat")
 	if err != nil {
-		return t, err
+		return result, err
 	}
 
 	client := newHttpClient(c.https)
 
 	response, err := client.Get(dest)
 	if err != nil {
-		return t, err
+		return result, err
 	}
 
 	defer response.Body.Close()
@@ -38,13 +45,9 @@ func (c *httpController) GetUptime() (time.Duration, error) {
 	data := new(bytes.Buffer)
 	data.ReadFrom(response.Body)
 
-	var result StatsResponse
-
 	if err := json.Unmarshal(data.Bytes(), &result); err != nil {
-		return t, err
+		return result, err
 	}
 
-	t = result.Uptime
-
-	return t, nil
+	return result, nil
 }
@@ -1,29 +1,184 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 )
 
+type submitResponse struct {
+	Status string `json:"status"`
+	Job    string `json:"job"`
+}
+
 func HttpSubmissions(opts Options, info *HttpsInfo) SubmissionApi {
 	return newHttpController(opts, info)
 }
 
-func (c *httpController) Submit(route string, data []byte) error {
+// Submit data to the given route. On success the id of
+// the job created for the submission is returned
+func (c *httpController) Submit(route string, data []byte) (string, error) {
+	return c.SubmitTagged(route, nil, data)
+}
+
+// Submit data to the given route along with tags that are handed
+// to the action, ex: the kind of sensor that took a reading
+func (c *httpController) SubmitTagged(route string, tags []string, data []byte) (string, error) {
+
+	encoded := ""
+	if len(tags) > 0 {
+		var err error
+		if encoded, err = ComposeTags(tags); err != nil {
+			return "", err
+		}
+	}
+
+	if c.opts.Gzip {
+		var err error
+		if data, err = compress(data); err != nil {
+			return "", err
+		}
+	}
+
+	key := ""
+	if c.opts.Retries > 0 {
+		var err error
+		if key, err = newIdempotencyKey(); err != nil {
+			return "", err
+		}
+	}
+
+	delay := c.opts.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+
+		job, retry, err := c.submitOnce(route, encoded, key, data)
+		if err == nil || retry < 0 || attempt >= c.opts.Retries {
+			return job, err
+		}
+
+		wait := max(delay, retry)
+
+		slog.Warn("retrying submission", "route", route, "attempt", attempt+1, "wait", wait, "error", err.Error())
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+// Make a single attempt at a submission. A failed attempt that is worth
+// making again reports how long the server asked to wait (0 if it didn't),
+// and one that isn't reports a negative wait
+func (c *httpController) submitOnce(route string, tags string, key string, data []byte) (string, time.Duration, error) {
 
-	request, err := buildHttpPostRequest("/submit/event", route, data, c.opts)
+	request, err := buildHttpPostRequest(HttpV1SubmitEvent, route, data, c.opts)
 	if err != nil {
-		return err
+		return "", -1, err
+	}
+
+	if tags != "" {
+		request.Header.Add("tags", tags)
+	}
+	if key != "" {
+		request.Header.Add(IdempotencyKeyHeader, key)
+	}
+	if c.opts.Gzip {
+		request.Header.Add("Content-Encoding", "gzip")
 	}
 
 	client := newHttpClient(c.https)
 
 	result, err := client.Do(request)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
+	defer result.Body.Close()
+
+	switch {
+	case result.StatusCode == http.StatusOK:
+	case result.StatusCode == http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(result.Header.Get("Retry-After"))
+		return "", time.Duration(seconds) * time.Second, ErrTooManyRequests
+	case result.StatusCode >= http.StatusInternalServerError,
+		result.StatusCode == http.StatusConflict:
+		return "", 0, ErrUnexpectedStatusCode
+	default:
+		return "", -1, ErrUnexpectedStatusCode
+	}
+
+	body := new(bytes.Buffer)
+	body.ReadFrom(result.Body)
+
+	var response submitResponse
+	if err := json.Unmarshal(body.Bytes(), &response); err != nil {
+		return "", -1, err
+	}
+	return response.Job, 0, nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func newIdempotencyKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Retrieve the status of a job previously submitted by this asset
+func (c *httpController) JobStatus(id string) (JobStatus, error) {
+
+	var status JobStatus
+
+	endpoint, err := url.JoinPath(HttpV1SubmitJob, id)
+	if err != nil {
+		return status, err
+	}
+
+	request, err := buildHttpGetRequest(endpoint, c.opts)
+	if err != nil {
+		return status, err
+	}
+
+	client := newHttpClient(c.https)
+
+	result, err := client.Do(request)
+	if err != nil {
+		return status, err
+	}
+
+	defer result.Body.Close()
+
 	if result.StatusCode != http.StatusOK {
-		return ErrUnexpectedStatusCode
+		return status, ErrUnexpectedStatusCode
+	}
+
+	body := new(bytes.Buffer)
+	body.ReadFrom(result.Body)
+
+	if err := json.Unmarshal(body.Bytes(), &status); err != nil {
+		return status, err
 	}
-	return nil
+	return status, nil
 }
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/traefik/yaegi/interp"
@@ -22,6 +23,45 @@ type Opts struct {
 	DataStore  datastore.DataStore
 	ActionMap  map[string]string
 	ActionPath string
+	Signals    map[string][]string
+	Runner     RunnerOpts
+
+	// Retrieves the current action map when actions are reloaded.
+	// If not set, reloads use the ActionMap given at startup
+	LoadActionMap func() (map[string]string, error)
+
+	// Retrieves the current set of disabled actions (see RunnerOpts.Disabled)
+	// when actions are reloaded. If not set, the set given at startup is kept
+	LoadDisabled func() ([]string, error)
+
+	// Interval at which the action sources are checked for
+	// changes to reload automatically. Zero disables watching
+	WatchActions time.Duration
+
+	// Named schedules that invoke actions without a submission
+	Schedules map[string]Schedule
+
+	// Submitted route patterns to the `action.Function` routes
+	// that handle them (see routes.go)
+	Routes map[string][]string
+
+	// Pipeline name to the `action.Function` routes of its
+	// stages, in the order they run (see pipeline.go)
+	Pipelines map[string][]string
+
+	// What is kept of each accepted event (see history.go)
+	EventHistory EventHistory
+
+	// How long the idempotency keys given with submissions are
+	// remembered (see idempotency.go). DefaultIdempotencyWindow if zero
+	IdempotencyWindow time.Duration
+
+	// Limits on how often each asset may submit events (see ratelimit.go)
+	RateLimits RateLimits
+
+	// Largest body accepted with a submission, once expanded if
+	// it was compressed (see payload.go). DefaultMaxBodySize if zero
+	MaxBodySize int64
 }
 
 type httpsInfo struct {
@@ -39,28 +79,101 @@ type App struct {
 
 	runner Runner
 
-	ctx context.Context
+	actionMap     map[string]string
+	loadActionMap func() (map[string]string, error)
+	loadDisabled  func() ([]string, error)
+	watchInterval time.Duration
+
+	schedules []*scheduleEntry
+	routes    *routeTable
+	history   EventHistory
+
+	idempotencyWindow time.Duration
+	limiter           *rateLimiter
+	maxBodySize       int64
+
+	// Cancelled when shutdown begins
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	server       *http.Server
+	shutdownOnce sync.Once
+	done         chan struct{} // Closed once shutdown completes
 }
 
 func New(options *Opts) (*App, error) {
 
+	if err := validateCapabilities(options.Runner.Capabilities); err != nil {
+		return nil, err
+	}
+
+	schedules, err := buildSchedules(options.Schedules)
+	if err != nil {
+		return nil, err
+	}
+
+	pipelines, err := buildPipelines(options.Pipelines, options.ActionMap, options.Runner.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := buildRouteTable(options.Routes, pipelines)
+	if err != nil {
+		return nil, err
+	}
+
+	runner := newYaegiRunner(options.Runner, options.DataStore)
+	runner.pipelines = pipelines
+
+	for signal, subscribers := range options.Signals {
+		for _, subscriber := range subscribers {
+			if err := runner.signals.add(signal, subscriber); err != nil {
+				slog.Error("failed to add configured signal subscriber", "signal", signal, "subscriber", subscriber)
+				return nil, err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	app := &App{
 		binding: options.Binding,
 		badge:   options.Badge,
 		db:      options.DataStore,
-		runner:  &yaegiRunner{},
-		ctx:     context.Background(),
+		runner:  runner,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+
+		actionMap:     options.ActionMap,
+		loadActionMap: options.LoadActionMap,
+		loadDisabled:  options.LoadDisabled,
+		watchInterval: options.WatchActions,
+		schedules:     schedules,
+		routes:        routes,
+		history:       options.EventHistory,
+
+		idempotencyWindow: options.IdempotencyWindow,
+		limiter:           newRateLimiter(options.RateLimits),
+		maxBodySize:       options.MaxBodySize,
 	}
 
 	if err := app.runner.Load(
 		options.ActionPath,
 		options.ActionMap,
-		app.buildYaegiExports()); err != nil {
+		app.buildYaegiExports); err != nil {
 
 		slog.Error("failed to load actions path", "error", err.Error())
 		return nil, err
 	}
 
+	// Anything accepted but not completed before the last
+	// shutdown is run now that the actions are available
+	if err := app.runner.Replay(); err != nil {
+		slog.Error("failed to replay unfinished jobs", "error", err.Error())
+		return nil, err
+	}
+
 	return app, nil
 }
 
@@ -108,19 +221,33 @@ func (a *App) Run(enableReleaseMode bool) {
 	// information (gossip/etc) from other emrs instances
 	a.setupSubmit(gins)
 
+	if a.watchInterval > 0 {
+		go a.watchActions(a.watchInterval)
+	}
+
+	a.startSchedules()
+
+	a.server = &http.Server{
+		Addr:    a.binding,
+		Handler: gins,
+	}
+
+	go a.handleSignals()
+
 	var err error
 	if a.httpsSettings != nil {
 		slog.Info("Using TLS")
-		err = gins.RunTLS(
-			a.binding,
+		err = a.server.ListenAndServeTLS(
 			a.httpsSettings.certPath,
 			a.httpsSettings.keyPath)
 	} else {
 		slog.Warn("Not using TLS")
-		err = gins.Run(a.binding)
+		err = a.server.ListenAndServe()
 	}
 
 	if errors.Is(err, http.ErrServerClosed) {
+		// Wait for the rest of the shutdown sequence
+		<-a.done
 	} else if err != nil {
 		slog.Error("error starting the server", "error", err.Error())
 		os.Exit(1)
@@ -159,27 +286,73 @@ func (a *App) validateRequest(origin string, token string) error {
 
 // The map built by this function offers-up application-specific functions
 // to the interpreter runtime that parses the user's code. Through this
-// mapping we offer the ability to interact with the EMRS system directly
-func (a *App) buildYaegiExports() interp.Exports {
+// mapping we offer the ability to interact with the EMRS system directly.
+// Each action gets its own map so the functions know who is calling them
+func (a *App) buildYaegiExports(action string) interp.Exports {
 
 	exports := make(map[string]map[string]reflect.Value)
 	exports["emrs/emrs"] = make(map[string]reflect.Value)
-	exports["emrs/emrs"]["Log"] = reflect.ValueOf(a.emrsFnLog)
-	exports["emrs/emrs"]["Emit"] = reflect.ValueOf(a.emrsFnEmit)
-	exports["emrs/emrs"]["Signal"] = reflect.ValueOf(a.emrsFnSignal)
+	exports["emrs/emrs"]["Log"] = reflect.ValueOf(func(x ...string) {
+		a.emrsFnLog(action, x...)
+	})
+	exports["emrs/emrs"]["Emit"] = reflect.ValueOf(func(signal string, data []byte) {
+		a.emrsFnEmit(action, signal, data)
+	})
+	exports["emrs/emrs"]["Signal"] = reflect.ValueOf(func(signal string) {
+		a.emrsFnSignal(action, signal)
+	})
+	exports["emrs/emrs"]["Subscribe"] = reflect.ValueOf(func(signal string, function string) error {
+		return a.emrsFnSubscribe(action, signal, function)
+	})
+	exports["emrs/emrs"]["After"] = reflect.ValueOf(func(delay time.Duration, route string, data []byte) error {
+		return a.emrsFnAfter(action, delay, route, data)
+	})
+	exports["emrs/emrs"]["Get"] = reflect.ValueOf(func(key string) ([]byte, error) {
+		return a.db.GetActionValue(action, key)
+	})
+	exports["emrs/emrs"]["Set"] = reflect.ValueOf(func(key string, value []byte) error {
+		return a.db.SetActionValue(action, key, value)
+	})
+	exports["emrs/emrs"]["Delete"] = reflect.ValueOf(func(key string) error {
+		return a.db.DeleteActionValue(action, key)
+	})
+	exports["emrs/emrs"]["Keys"] = reflect.ValueOf(func(prefix string) ([]string, error) {
+		return a.db.GetActionKeys(action, prefix)
+	})
+	exports["emrs/emrs"]["Event"] = reflect.ValueOf((*Event)(nil))
+	exports["emrs/emrs"]["ErrNotFound"] = reflect.ValueOf(&datastore.ErrNotFound).Elem()
+	exports["emrs/emrs"]["Halt"] = reflect.ValueOf(&ErrHalt).Elem()
+	exports["emrs/emrs"]["Decode"] = reflect.ValueOf(DecodeEvent)
+	exports["emrs/emrs"]["DecodeJSON"] = reflect.ValueOf(DecodeJSON)
+	exports["emrs/emrs"]["DecodeCBOR"] = reflect.ValueOf(DecodeCBOR)
+	exports["emrs/emrs"]["DecodeMsgpack"] = reflect.ValueOf(DecodeMsgpack)
+	exports["emrs/emrs"]["ErrMalformedPayload"] = reflect.ValueOf(&ErrMalformedPayload).Elem()
 	return exports
 }
 
-func (a *App) emrsFnLog(x ...string) {
-	slog.Info("emrs-log", "value", x)
+func (a *App) emrsFnLog(action string, x ...string) {
+	slog.Debug("emrs-log", "action", action, "value", x)
+	a.runner.Log(action, strings.Join(x, " "))
 }
 
-func (a *App) emrsFnEmit(signal string, data []byte) {
+func (a *App) emrsFnEmit(action string, signal string, data []byte) {
+
+	slog.Debug("emit requested", "action", action, "signal", signal, "size", len(data))
 
-	slog.Info("EMIT REQUESTED ==> TODO: Fire off a signal with data", "signal", signal, "data", data)
+	if err := a.runner.Emit(action, signal, data); err != nil {
+		slog.Error("failed to emit signal", "action", action, "signal", signal, "error", err.Error())
+	}
 }
 
-func (a *App) emrsFnSignal(signal string) {
+func (a *App) emrsFnSignal(action string, signal string) {
+
+	slog.Debug("signal requested", "action", action, "signal", signal)
+
+	if err := a.runner.Emit(action, signal, nil); err != nil {
+		slog.Error("failed to raise signal", "action", action, "signal", signal, "error", err.Error())
+	}
+}
 
-	slog.Info("SIGNAL REQUESTED ==> TODO: Fire off a signal with NO data", "signal", signal)
+func (a *App) emrsFnSubscribe(action string, signal string, function string) error {
+	return a.runner.Subscribe(action, signal, function)
 }
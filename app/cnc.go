@@ -1,10 +1,14 @@
 package app
 
 import (
+	"errors"
+	"fmt"
+	"github.com/bosley/emrs/api"
+	"github.com/bosley/emrs/datastore"
 	"github.com/gin-gonic/gin"
 	"log/slog"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 )
 
@@ -14,6 +18,17 @@ func (a *App) setupCNC(gins *gin.Engine) {
 	priv.Use(a.CNCAuthentication())
 	{
 		priv.POST("/shutdown", a.cncShutdown)
+
+		priv.GET("/deadletter", a.cncDeadLetterList)
+		priv.POST("/deadletter/retry", a.cncDeadLetterRetry)
+		priv.POST("/deadletter/purge", a.cncDeadLetterPurge)
+
+		priv.GET("/actions", a.cncActions)
+		priv.POST("/actions/reload", a.cncReloadActions)
+		priv.GET("/actions/output", a.cncActionOutput)
+
+		priv.GET("/events", a.cncEvents)
+		priv.POST("/events/replay", a.cncEventsReplay)
 	}
 }
 
@@ -55,26 +70,313 @@ func (a *App) cncShutdown(c *gin.Context) {
 
 	slog.Info("CNC SHUTDOWN REQUEST")
 
-	println(`
+	// The response is sent before the http server is
+	// stopped, which waits for open requests like this one
+	a.shutdownInBackground()
 
-    TODO:
+	c.JSON(200, gin.H{
+		"status": "shutdown imminent",
+	})
+}
 
-      The CNC server has received a shutdown request.
-      For now we are going to exit without grace.
+func (a *App) cncDeadLetterList(c *gin.Context) {
 
-      We need to instrument the server with a coordinated,
-      gentle, and correct shutdown sequence
+	letters := a.db.GetDeadLetters()
 
+	result := make([]api.DeadLetter, 0, len(letters))
+	for _, letter := range letters {
+		result = append(result, api.DeadLetter{
+			Id:       letter.Id,
+			Origin:   letter.Origin,
+			Route:    letter.Route,
+			Data:     letter.Data,
+			Attempts: letter.Attempts,
+			Error:    letter.Error,
+			Failed:   letter.Failed,
+		})
+	}
+
+	c.JSON(200, result)
+}
 
-  `)
+// Re-drive the dead letter named in the `job` header through
+// the runner. If no job is given, every dead letter is retried
+func (a *App) cncDeadLetterRetry(c *gin.Context) {
 
-	go func() {
-		time.Sleep(2 * time.Second)
-		println("TIMED SHUTDOWN TRIGGERED")
-		os.Exit(55)
-	}()
+	ids := a.deadLetterTargets(c.GetHeader("job"))
+
+	count := 0
+	for _, id := range ids {
+		if err := a.runner.RetryDeadLetter(id); err != nil {
+			slog.Error("failed to retry dead letter", "id", id, "error", err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "failed to retry dead letter",
+				"job":     id,
+				"error":   err.Error(),
+				"retried": count,
+			})
+			return
+		}
+		count++
+	}
 
 	c.JSON(200, gin.H{
-		"status": "shutdown imminent",
+		"status":  "complete",
+		"retried": count,
+	})
+}
+
+// Remove the dead letter named in the `job` header.
+// If no job is given, every dead letter is removed
+func (a *App) cncDeadLetterPurge(c *gin.Context) {
+
+	job := c.GetHeader("job")
+
+	var err error
+	count := 1
+	if job == "" {
+		count = len(a.db.GetDeadLetters())
+		err = a.db.PurgeDeadLetters()
+	} else {
+		if _, e := a.db.GetDeadLetter(job); e != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "not found",
+				"job":    job,
+			})
+			return
+		}
+		err = a.db.RemoveDeadLetter(job)
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "failed to purge dead letters",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "complete",
+		"purged": count,
+	})
+}
+
+func (a *App) deadLetterTargets(job string) []string {
+	if job != "" {
+		return []string{job}
+	}
+	letters := a.db.GetDeadLetters()
+	ids := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		ids = append(ids, letter.Id)
+	}
+	return ids
+}
+
+func (a *App) cncReloadActions(c *gin.Context) {
+
+	slog.Info("CNC RELOAD ACTIONS REQUEST")
+
+	reloaded, err := a.reloadActions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "failed to reload actions",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":   "complete",
+		"reloaded": reloaded,
+	})
+}
+
+func (a *App) cncActions(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"loaded": a.runner.Actions(),
+	})
+}
+
+// Output of the action named in the `action` header, limited to
+// lines numbered after the `after` header if one is given
+func (a *App) cncActionOutput(c *gin.Context) {
+
+	action := c.GetHeader("action")
+
+	var after int64
+	if value := c.GetHeader("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseInt(value, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "bad after value",
+			})
+			return
+		}
+	}
+
+	lines, err := a.runner.Output(action, after)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "unknown action",
+			"action": action,
+		})
+		return
+	}
+
+	result := make([]api.OutputLine, 0, len(lines))
+	for _, line := range lines {
+		result = append(result, api.OutputLine{
+			Seq:    line.Seq,
+			Time:   line.Time,
+			Stream: line.Stream,
+			Text:   line.Text,
+		})
+	}
+
+	c.JSON(200, result)
+}
+
+// Events matching the filters given in the `asset`, `route` (prefix),
+// `since` and `until` (RFC3339), `status` and `limit` headers
+func (a *App) cncEvents(c *gin.Context) {
+
+	filter, err := eventFilterFromHeaders(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "bad filter",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	events, err := a.db.GetEvents(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "failed to retrieve events",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	result := make([]api.EventRecord, 0, len(events))
+	for _, event := range events {
+		result = append(result, api.EventRecord{
+			Id:       event.Id,
+			Origin:   event.Origin,
+			Route:    event.Route,
+			Size:     event.Size,
+			Payload:  event.Payload,
+			Received: event.Received,
+			Jobs:     event.Jobs,
+			Outcome:  event.Outcome,
+			Error:    event.Error,
+		})
+	}
+
+	c.JSON(200, result)
+}
+
+// Replay the events matching the same filters as cncEvents, to the
+// route given in the `to` header if there is one. Events without their
+// data are skipped. Replaying stops at the first job that can't be submitted
+func (a *App) cncEventsReplay(c *gin.Context) {
+
+	filter, err := eventFilterFromHeaders(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "bad filter",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var route []string
+	if to := c.GetHeader("to"); to != "" {
+		if route, err = api.DecomposeRoute(to); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "bad route",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	slog.Info("CNC EVENTS REPLAY REQUEST", "to", route)
+
+	events, err := a.db.GetEvents(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "failed to retrieve events",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	replayed := 0
+	skipped := 0
+	jobs := make([]string, 0, len(events))
+	for _, event := range events {
+
+		submitted, err := a.replayEvent(event, route)
+		jobs = append(jobs, submitted...)
+
+		if errors.Is(err, ErrNoPayload) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to replay event", "event", event.Id, "error", err.Error())
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":   "replay incomplete",
+				"error":    err.Error(),
+				"replayed": replayed,
+				"skipped":  skipped,
+				"jobs":     jobs,
+			})
+			return
+		}
+		replayed++
+	}
+
+	c.JSON(200, gin.H{
+		"status":   "complete",
+		"replayed": replayed,
+		"skipped":  skipped,
+		"jobs":     jobs,
 	})
 }
+
+func eventFilterFromHeaders(c *gin.Context) (datastore.EventFilter, error) {
+
+	filter := datastore.EventFilter{
+		Origin:      c.GetHeader("asset"),
+		RoutePrefix: c.GetHeader("route"),
+		Outcome:     c.GetHeader("status"),
+	}
+
+	switch filter.Outcome {
+	case "", datastore.EventPending, datastore.EventSucceeded, datastore.EventFailed:
+	default:
+		return filter, fmt.Errorf("unknown status '%s'", filter.Outcome)
+	}
+
+	var err error
+	if value := c.GetHeader("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return filter, fmt.Errorf("bad since value: %w", err)
+		}
+	}
+	if value := c.GetHeader("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return filter, fmt.Errorf("bad until value: %w", err)
+		}
+	}
+	if value := c.GetHeader("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 0 {
+			return filter, fmt.Errorf("bad limit value '%s'", value)
+		}
+	}
+	return filter, nil
+}
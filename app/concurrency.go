@@ -0,0 +1,238 @@
+package app
+
+/*
+
+   The interpreter behind an action is shared by every job sent to it, so
+   by default an action may be running any number of jobs at once. Actions
+   that keep package level state, or that need events handled in the order
+   they arrived, can be limited:
+
+      serial              one job at a time
+      max N               at most N jobs at a time
+      per-origin serial   one job at a time from each origin
+      per-origin max N    at most N jobs at a time from each origin
+
+   Each job is given its place in line as it is queued, and jobs are only
+   let through in that order, so that they run in the order they arrived
+   whichever worker picks them up. Jobs over the limit wait for a running
+   job to finish. A job waiting to be retried keeps its place, so the jobs
+   behind it wait for the retry as well.
+
+   A job abandoned for exceeding the time limit keeps its place for as long
+   as the interpreter is still running it, and is only retried (or gives up
+   its place) once the abandoned call returns.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidConcurrency = errors.New("invalid concurrency setting")
+
+const (
+	concurrencySerial    = "serial"
+	concurrencyMax       = "max"
+	concurrencyPerOrigin = "per-origin"
+)
+
+type Concurrency struct {
+	Limit     int  // Number of jobs that may run at once (<= 0 is unlimited)
+	PerOrigin bool // Apply the limit to each origin separately
+}
+
+// Parse a setting of the form "[per-origin] serial|max N"
+func ParseConcurrency(setting string) (Concurrency, error) {
+
+	fields := strings.Fields(setting)
+
+	var c Concurrency
+	if len(fields) > 0 && fields[0] == concurrencyPerOrigin {
+		c.PerOrigin = true
+		fields = fields[1:]
+	}
+
+	switch {
+	case len(fields) == 1 && fields[0] == concurrencySerial:
+		c.Limit = 1
+	case len(fields) == 2 && fields[0] == concurrencyMax:
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			return c, fmt.Errorf("%w: '%s' requires a positive limit", ErrInvalidConcurrency, setting)
+		}
+		c.Limit = n
+	default:
+		return c, fmt.Errorf("%w: '%s'", ErrInvalidConcurrency, setting)
+	}
+	return c, nil
+}
+
+type gate struct {
+	active int
+	issued uint64 // Places given out so far
+	next   uint64 // The place of the next job to be let through
+
+	// Jobs that reached a worker before their turn or over the
+	// limit, by place. Places given up before the job ran are nil
+	waiting map[uint64]*Job
+}
+
+// Tracks the jobs running against each limited action (or action
+// and origin) and those waiting on them
+type concurrencyGates struct {
+	mu     sync.Mutex
+	limits map[string]Concurrency
+	gates  map[string]*gate
+}
+
+func newConcurrencyGates(limits map[string]Concurrency) *concurrencyGates {
+	if limits == nil {
+		limits = make(map[string]Concurrency)
+	}
+	return &concurrencyGates{
+		limits: limits,
+		gates:  make(map[string]*gate),
+	}
+}
+
+func (g *concurrencyGates) key(job *Job) (string, int, bool) {
+	if len(job.Destination) == 0 {
+		return "", 0, false
+	}
+	action := job.Destination[0]
+	limit, ok := g.limits[action]
+	if !ok || limit.Limit <= 0 {
+		return "", 0, false
+	}
+	if limit.PerOrigin {
+		return action + "\x00" + job.Origin, limit.Limit, true
+	}
+	return action, limit.Limit, true
+}
+
+// Must be called with the lock held
+func (g *concurrencyGates) entry(key string) *gate {
+	entry, ok := g.gates[key]
+	if !ok {
+		entry = &gate{waiting: make(map[uint64]*Job)}
+		g.gates[key] = entry
+	}
+	return entry
+}
+
+// Give the job its place in line. Jobs are placed as they are queued, so
+// that they run in the order they arrived whichever worker picks them up
+func (g *concurrencyGates) place(job *Job) {
+
+	key, _, limited := g.key(job)
+	if !limited {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entry := g.entry(key)
+	job.place = entry.issued
+	job.placed = true
+	entry.issued++
+}
+
+// Give up the place of a job that will not be run, returning
+// any jobs that were waiting on it and may now run
+func (g *concurrencyGates) withdraw(job *Job) []*Job {
+
+	key, limit, limited := g.key(job)
+	if !limited || !job.placed {
+		return nil
+	}
+	job.placed = false
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entry := g.entry(key)
+	entry.waiting[job.place] = nil
+	return g.admit(key, entry, limit)
+}
+
+// Take a place for the job, returning the jobs that may now run: the job
+// itself unless it must wait, along with any jobs that were waiting on it
+func (g *concurrencyGates) acquire(job *Job) []*Job {
+
+	if job.gated {
+		return []*Job{job}
+	}
+
+	key, limit, limited := g.key(job)
+	if !limited {
+		return []*Job{job}
+	}
+
+	if !job.placed {
+		g.place(job)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entry := g.entry(key)
+	entry.waiting[job.place] = job
+	return g.admit(key, entry, limit)
+}
+
+// Give up the job's place, returning the jobs that may now run
+func (g *concurrencyGates) release(job *Job) []*Job {
+
+	if !job.gated {
+		return nil
+	}
+	job.gated = false
+	job.placed = false
+
+	key, limit, _ := g.key(job)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entry, ok := g.gates[key]
+	if !ok {
+		return nil
+	}
+
+	entry.active--
+	return g.admit(key, entry, limit)
+}
+
+// Let through the waiting jobs whose turn it is, for as long as the limit
+// allows. Must be called with the lock held
+func (g *concurrencyGates) admit(key string, entry *gate, limit int) []*Job {
+
+	var ready []*Job
+	for {
+		job, ok := entry.waiting[entry.next]
+		if !ok {
+			break
+		}
+		if job != nil && entry.active >= limit {
+			break
+		}
+		delete(entry.waiting, entry.next)
+		entry.next++
+		if job == nil {
+			continue
+		}
+		entry.active++
+		job.gated = true
+		ready = append(ready, job)
+	}
+
+	if entry.active <= 0 && entry.next == entry.issued {
+		delete(g.gates, key)
+	}
+	return ready
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseConcurrency(t *testing.T) {
+
+	cases := map[string]Concurrency{
+		"serial":            {Limit: 1},
+		"max 4":             {Limit: 4},
+		"per-origin serial": {Limit: 1, PerOrigin: true},
+		"per-origin max 2":  {Limit: 2, PerOrigin: true},
+	}
+
+	for setting, expected := range cases {
+		c, err := ParseConcurrency(setting)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %v", setting, err)
+		}
+		if c != expected {
+			t.Fatalf("'%s': expected %+v, got %+v", setting, expected, c)
+		}
+	}
+
+	for _, setting := range []string{"", "max", "max 0", "max -1", "max x", "per-origin", "parallel"} {
+		if _, err := ParseConcurrency(setting); !errors.Is(err, ErrInvalidConcurrency) {
+			t.Fatalf("expected '%s' to be invalid, got %v", setting, err)
+		}
+	}
+}
+
+func TestConcurrencyGates(t *testing.T) {
+
+	gates := newConcurrencyGates(map[string]Concurrency{
+		"serial": {Limit: 1},
+		"origin": {Limit: 1, PerOrigin: true},
+	})
+
+	job := func(action string, origin string) *Job {
+		return &Job{Origin: origin, Destination: []string{action, "Fn"}}
+	}
+
+	runs := func(job *Job, ready []*Job) bool {
+		return slices.Contains(ready, job)
+	}
+
+	// Unlimited actions are never held
+	free := job("free", "a")
+	if !runs(free, gates.acquire(free)) {
+		t.Fatal("expected unlimited action to run")
+	}
+	if gates.release(free) != nil {
+		t.Fatal("unexpected job released from unlimited action")
+	}
+
+	// Serial actions hold jobs in order
+	first, second, third := job("serial", "a"), job("serial", "b"), job("serial", "c")
+	if !runs(first, gates.acquire(first)) {
+		t.Fatal("expected first job to run")
+	}
+	if len(gates.acquire(second)) != 0 || len(gates.acquire(third)) != 0 {
+		t.Fatal("expected later jobs to be held")
+	}
+	if next := gates.release(first); !slices.Equal(next, []*Job{second}) {
+		t.Fatal("expected second job to be handed the place")
+	}
+	if next := gates.release(second); !slices.Equal(next, []*Job{third}) {
+		t.Fatal("expected third job to be handed the place")
+	}
+	if next := gates.release(third); next != nil {
+		t.Fatal("expected no more jobs")
+	}
+	if last := job("serial", "a"); !runs(last, gates.acquire(last)) {
+		t.Fatal("expected a free place once all jobs finished")
+	}
+
+	// Per-origin limits only hold jobs from the same origin
+	a1, a2, b1 := job("origin", "a"), job("origin", "a"), job("origin", "b")
+	if !runs(a1, gates.acquire(a1)) || !runs(b1, gates.acquire(b1)) {
+		t.Fatal("expected jobs from different origins to run")
+	}
+	if len(gates.acquire(a2)) != 0 {
+		t.Fatal("expected second job from the same origin to be held")
+	}
+	if gates.release(b1) != nil {
+		t.Fatal("unexpected job handed over from another origin")
+	}
+	if !slices.Equal(gates.release(a1), []*Job{a2}) {
+		t.Fatal("expected job from the same origin to be handed the place")
+	}
+
+	// A job holding its place (waiting on a retry) is let through
+	if !runs(a2, gates.acquire(a2)) {
+		t.Fatal("expected job holding its place to run")
+	}
+}
+
+func TestConcurrencyGatesOrder(t *testing.T) {
+
+	gates := newConcurrencyGates(map[string]Concurrency{
+		"pair": {Limit: 2},
+	})
+
+	jobs := make([]*Job, 4)
+	for i := range jobs {
+		jobs[i] = &Job{Origin: "a", Destination: []string{"pair", "Fn"}}
+		gates.place(jobs[i])
+	}
+
+	// Jobs reaching a worker ahead of their turn wait for the jobs before them
+	if len(gates.acquire(jobs[1])) != 0 || len(gates.acquire(jobs[3])) != 0 {
+		t.Fatal("expected jobs out of turn to be held")
+	}
+	if ready := gates.acquire(jobs[0]); !slices.Equal(ready, []*Job{jobs[0], jobs[1]}) {
+		t.Fatalf("expected the first two jobs to run, got %v", ready)
+	}
+
+	// A job that was never run gives up its place to the jobs behind it
+	if ready := gates.withdraw(jobs[2]); ready != nil {
+		t.Fatal("expected the limit to hold the jobs behind a withdrawn job")
+	}
+	if ready := gates.release(jobs[0]); !slices.Equal(ready, []*Job{jobs[3]}) {
+		t.Fatalf("expected the last job to run, got %v", ready)
+	}
+}
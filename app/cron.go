@@ -0,0 +1,198 @@
+package app
+
+/*
+
+   A minimal cron expression, the five standard fields:
+
+      minute  hour  day-of-month  month  day-of-week
+      0-59    0-23  1-31          1-12   0-6 (sunday is 0 or 7)
+
+   Each field may be `*`, a number, a range (1-5), a list (1,15,30)
+   or any of those followed by a step (0-30/10 is 0, 10, 20 and 30).
+   The usual shorthands @hourly, @daily (@midnight), @weekly,
+   @monthly and @yearly (@annually) are understood as well.
+
+   As with cron, when both day fields are restricted a time
+   matching either of them is a match.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCron = errors.New("invalid cron expression")
+
+// How far ahead to look for a matching time before giving up
+// on an expression that can never match (ex: 30 2 31 2 *)
+const cronSearchYears = 5
+
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+type cronField struct {
+	min int
+	max int
+}
+
+var cronFields = []cronField{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week
+}
+
+type cronExpr struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+
+	domAny bool
+	dowAny bool
+}
+
+func parseCron(expression string) (*cronExpr, error) {
+
+	expression = strings.TrimSpace(expression)
+	if full, ok := cronShorthands[expression]; ok {
+		expression = full
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%w: expected %d fields in '%s'", ErrInvalidCron, len(cronFields), expression)
+	}
+
+	sets := make([][]bool, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	expr := &cronExpr{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	copy(expr.minute[:], sets[0])
+	copy(expr.hour[:], sets[1])
+	copy(expr.dom[:], sets[2])
+	copy(expr.month[:], sets[3])
+	copy(expr.dow[:], sets[4])
+
+	// Sunday may be given as 7
+	if sets[4][7] {
+		expr.dow[0] = true
+	}
+	return expr, nil
+}
+
+func parseCronField(field string, bounds cronField) ([]bool, error) {
+
+	set := make([]bool, bounds.max+1)
+
+	for _, part := range strings.Split(field, ",") {
+
+		step := 1
+		if value, stepping, ok := strings.Cut(part, "/"); ok {
+			s, err := strconv.Atoi(stepping)
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("%w: bad step in '%s'", ErrInvalidCron, field)
+			}
+			part = value
+			step = s
+		}
+
+		low, high := bounds.min, bounds.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			from, to, _ := strings.Cut(part, "-")
+			var err error
+			if low, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("%w: bad range in '%s'", ErrInvalidCron, field)
+			}
+			if high, err = strconv.Atoi(to); err != nil {
+				return nil, fmt.Errorf("%w: bad range in '%s'", ErrInvalidCron, field)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad value in '%s'", ErrInvalidCron, field)
+			}
+			low = value
+			high = value
+			if step > 1 {
+				high = bounds.max
+			}
+		}
+
+		if low < bounds.min || high > bounds.max || low > high {
+			return nil, fmt.Errorf("%w: '%s' out of range %d-%d", ErrInvalidCron, field, bounds.min, bounds.max)
+		}
+
+		for i := low; i <= high; i += step {
+			set[i] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronExpr) matchesDay(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[t.Weekday()]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// The first time strictly after the given time that matches the
+// expression, or the zero time if no such time could be found
+func (c *cronExpr) next(after time.Time) time.Time {
+
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if !c.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+
+	// A thursday
+	from := time.Date(2024, time.February, 1, 10, 30, 15, 0, time.UTC)
+
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.February, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.February, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 8 * * *", time.Date(2024, time.February, 2, 8, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, time.February, 2, 10, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, time.February, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 0", time.Date(2024, time.February, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2024, time.February, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 6", time.Date(2024, time.February, 3, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, c := range cases {
+		expr, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %v", c.expr, err)
+		}
+		if next := expr.next(from); !next.Equal(c.expected) {
+			t.Fatalf("'%s': expected %v, got %v", c.expr, c.expected, next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(expr); !errors.Is(err, ErrInvalidCron) {
+			t.Fatalf("expected '%s' to be invalid, got %v", expr, err)
+		}
+	}
+}
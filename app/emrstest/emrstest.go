@@ -0,0 +1,231 @@
+// Package emrstest provides a test double for the `emrs` package that
+// installed actions import, so that actions can be tested without a
+// running server.
+//
+// A Recorder stands in for the runtime and records every call made to
+// it. Actions under test can inspect the recording by importing the
+// `emrstest` package offered alongside the fake `emrs` package:
+//
+//	package door
+//
+//	import (
+//	    "emrstest"
+//	    "testing"
+//	)
+//
+//	func TestKnock(t *testing.T) {
+//	    emrstest.Reset()
+//	    Knock("origin", nil, []byte("hello"))
+//	    if len(emrstest.Emits()) != 1 {
+//	        t.Fatal("expected the door to emit a signal")
+//	    }
+//	}
+//
+// RunTests loads an action and its tests into an interpreter wired to a
+// Recorder and runs every `func TestXxx(*testing.T)` that it finds.
+package emrstest
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosley/emrs/app"
+	"github.com/bosley/emrs/datastore"
+	"github.com/traefik/yaegi/interp"
+)
+
+// A signal raised through Emit or Signal (Data is nil for Signal)
+type Emission struct {
+	Signal string
+	Data   []byte
+}
+
+// A call to Subscribe
+type Subscription struct {
+	Signal   string
+	Function string
+}
+
+// A call to After
+type Timer struct {
+	Delay time.Duration
+	Route string
+	Data  []byte
+}
+
+type Recorder struct {
+	mu            sync.Mutex
+	logs          [][]string
+	emits         []Emission
+	subscriptions []Subscription
+	timers        []Timer
+	values        map[string][]byte
+}
+
+func New() *Recorder {
+	r := &Recorder{}
+	r.Reset()
+	return r
+}
+
+// Forget everything recorded so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = make([][]string, 0)
+	r.emits = make([]Emission, 0)
+	r.subscriptions = make([]Subscription, 0)
+	r.timers = make([]Timer, 0)
+	r.values = make(map[string][]byte)
+}
+
+func (r *Recorder) Log(x ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = append(r.logs, append([]string{}, x...))
+}
+
+func (r *Recorder) Emit(signal string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emits = append(r.emits, Emission{
+		Signal: signal,
+		Data:   append([]byte{}, data...),
+	})
+}
+
+func (r *Recorder) Signal(signal string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emits = append(r.emits, Emission{
+		Signal: signal,
+	})
+}
+
+func (r *Recorder) Subscribe(signal string, function string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions = append(r.subscriptions, Subscription{
+		Signal:   signal,
+		Function: function,
+	})
+	return nil
+}
+
+// Timers are recorded but never fire
+func (r *Recorder) After(delay time.Duration, route string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timers = append(r.timers, Timer{
+		Delay: delay,
+		Route: route,
+		Data:  append([]byte{}, data...),
+	})
+	return nil
+}
+
+// Stored values are kept in memory rather than the datastore,
+// and are forgotten on Reset
+
+func (r *Recorder) Get(key string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.values[key]
+	if !ok {
+		return nil, datastore.ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (r *Recorder) Set(key string, value []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (r *Recorder) Delete(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.values, key)
+	return nil
+}
+
+func (r *Recorder) Keys(prefix string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0)
+	for key := range r.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (r *Recorder) Logs() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string{}, r.logs...)
+}
+
+// Every call to Emit and Signal, in the order they were made
+func (r *Recorder) Emits() []Emission {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Emission{}, r.emits...)
+}
+
+func (r *Recorder) Subscriptions() []Subscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Subscription{}, r.subscriptions...)
+}
+
+func (r *Recorder) Timers() []Timer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Timer{}, r.timers...)
+}
+
+// The symbols to hand to an interpreter. `emrs` is backed by the recorder
+// in place of the server, and `emrstest` lets the interpreted code
+// inspect what has been recorded
+func (r *Recorder) Exports() interp.Exports {
+
+	exports := make(map[string]map[string]reflect.Value)
+
+	exports["emrs/emrs"] = make(map[string]reflect.Value)
+	exports["emrs/emrs"]["Log"] = reflect.ValueOf(r.Log)
+	exports["emrs/emrs"]["Emit"] = reflect.ValueOf(r.Emit)
+	exports["emrs/emrs"]["Signal"] = reflect.ValueOf(r.Signal)
+	exports["emrs/emrs"]["Subscribe"] = reflect.ValueOf(r.Subscribe)
+	exports["emrs/emrs"]["After"] = reflect.ValueOf(r.After)
+	exports["emrs/emrs"]["Get"] = reflect.ValueOf(r.Get)
+	exports["emrs/emrs"]["Set"] = reflect.ValueOf(r.Set)
+	exports["emrs/emrs"]["Delete"] = reflect.ValueOf(r.Delete)
+	exports["emrs/emrs"]["Keys"] = reflect.ValueOf(r.Keys)
+	exports["emrs/emrs"]["Event"] = reflect.ValueOf((*app.Event)(nil))
+	exports["emrs/emrs"]["ErrNotFound"] = reflect.ValueOf(&datastore.ErrNotFound).Elem()
+	exports["emrs/emrs"]["Halt"] = reflect.ValueOf(&app.ErrHalt).Elem()
+	exports["emrs/emrs"]["Decode"] = reflect.ValueOf(app.DecodeEvent)
+	exports["emrs/emrs"]["DecodeJSON"] = reflect.ValueOf(app.DecodeJSON)
+	exports["emrs/emrs"]["DecodeCBOR"] = reflect.ValueOf(app.DecodeCBOR)
+	exports["emrs/emrs"]["DecodeMsgpack"] = reflect.ValueOf(app.DecodeMsgpack)
+	exports["emrs/emrs"]["ErrMalformedPayload"] = reflect.ValueOf(&app.ErrMalformedPayload).Elem()
+
+	exports["emrstest/emrstest"] = make(map[string]reflect.Value)
+	exports["emrstest/emrstest"]["Reset"] = reflect.ValueOf(r.Reset)
+	exports["emrstest/emrstest"]["Logs"] = reflect.ValueOf(r.Logs)
+	exports["emrstest/emrstest"]["Emits"] = reflect.ValueOf(r.Emits)
+	exports["emrstest/emrstest"]["Subscriptions"] = reflect.ValueOf(r.Subscriptions)
+	exports["emrstest/emrstest"]["Timers"] = reflect.ValueOf(r.Timers)
+	exports["emrstest/emrstest"]["Emission"] = reflect.ValueOf((*Emission)(nil))
+	exports["emrstest/emrstest"]["Subscription"] = reflect.ValueOf((*Subscription)(nil))
+	exports["emrstest/emrstest"]["Timer"] = reflect.ValueOf((*Timer)(nil))
+	return exports
+}
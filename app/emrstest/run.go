@@ -0,0 +1,160 @@
+package emrstest
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/traefik/yaegi/interp"
+	"github.com/traefik/yaegi/stdlib"
+)
+
+var ErrNoTests = errors.New("no tests found")
+
+type Options struct {
+	// Where packages imported by the action can be found
+	// (the actions directory of an emrs home)
+	GoPath string
+
+	// Only run tests matching this expression (as `go test -run`)
+	Run string
+
+	// Report every test as it is run, not just failures
+	Verbose bool
+}
+
+// Load an action and its tests into an interpreter backed by a new Recorder
+// and run its tests. The source may be a single go file, in which case a
+// `_test.go` file next to it is loaded as well, or a package directory.
+//
+// Once loaded, the tests are handed to the testing package in the same way
+// a `go test` binary would, which means that this only returns on failure
+// to load the tests. Otherwise the process exits with the test result
+func RunTests(source string, opts Options) error {
+
+	tests, err := loadTests(source, opts.GoPath)
+	if err != nil {
+		return err
+	}
+
+	// The testing package reads its settings from the command line
+	args := []string{os.Args[0]}
+	if opts.Verbose {
+		args = append(args, "-test.v")
+	}
+	if opts.Run != "" {
+		args = append(args, "-test.run", opts.Run)
+	}
+	os.Args = args
+
+	testing.Main(regexp.MatchString, tests, nil, nil)
+	return nil
+}
+
+func loadTests(source string, goPath string) ([]testing.InternalTest, error) {
+
+	files, err := testSourceFiles(source)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := packageName(files[0])
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := New()
+
+	env := interp.New(interp.Options{GoPath: goPath})
+
+	if err := env.Use(stdlib.Symbols); err != nil {
+		return nil, err
+	}
+
+	if err := env.Use(recorder.Exports()); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if _, err := env.EvalPath(file); err != nil {
+			return nil, err
+		}
+	}
+
+	tests := make([]testing.InternalTest, 0)
+	for name, symbol := range env.Symbols(pkg)[pkg] {
+		if !strings.HasPrefix(name, "Test") {
+			continue
+		}
+		if fn, ok := symbol.Interface().(func(*testing.T)); ok {
+			tests = append(tests, testing.InternalTest{Name: name, F: fn})
+		}
+	}
+
+	if len(tests) == 0 {
+		return nil, ErrNoTests
+	}
+
+	slices.SortFunc(tests, func(a, b testing.InternalTest) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return tests, nil
+}
+
+// Non-test files are loaded before test files so that
+// the tests are evaluated against the complete package
+func testSourceFiles(source string) ([]string, error) {
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		files := []string{source}
+		test := strings.TrimSuffix(source, ".go") + "_test.go"
+		if _, err := os.Stat(test); err == nil && test != source {
+			files = append(files, test)
+		}
+		return files, nil
+	}
+
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	tests := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		if strings.HasSuffix(name, "_test.go") {
+			tests = append(tests, filepath.Join(source, name))
+		} else {
+			files = append(files, filepath.Join(source, name))
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no go files found in %s", source)
+	}
+	return append(files, tests...), nil
+}
+
+func packageName(file string) (string, error) {
+	parsed, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Name.Name, nil
+}
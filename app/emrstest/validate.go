@@ -0,0 +1,298 @@
+package emrstest
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bosley/emrs/app"
+	"github.com/traefik/yaegi/interp"
+)
+
+var (
+	ErrPackageName = errors.New("package name does not match the action name")
+	ErrNoHandlers  = errors.New("no handler functions found")
+	ErrHookType    = errors.New("hook must be of type func() error")
+)
+
+// Functions the runner calls itself rather than routing events to
+var actionHooks = []string{"OnInit", "OnShutdown"}
+
+// An action that is about to be installed
+type Action struct {
+	Name   string // The name the action is installed under
+	Source string // A go file or package directory
+
+	// Where a package directory will be installed within the
+	// GoPath (its module path). Defaults to the action name
+	ImportPath string
+
+	// The capabilities the action will be given on the server.
+	// None is every package the interpreter offers
+	Capabilities []string
+}
+
+// What was found in an action that passed validation
+type Report struct {
+	Package  string
+	Handlers []string // Exported functions that events can be routed to
+}
+
+// Load an action the way the server would, backed by a Recorder rather
+// than a running server, and check that it can be installed:
+//
+//   - It declares a package named after the action
+//   - It imports nothing outside of its capabilities
+//   - It compiles, along with anything it imports from the GoPath
+//   - OnInit and OnShutdown, if present, are of type func() error
+//   - It has at least one exported handler function
+//
+// Package directories are loaded as though they were already installed
+// at their import path in the GoPath, hiding any installed copy. Loading
+// runs the action's package initializers (variable initialization and
+// init functions) as the server would, but OnInit and handlers are not run
+func Validate(action Action, opts Options) (Report, error) {
+
+	report := Report{}
+
+	info, err := os.Stat(action.Source)
+	if err != nil {
+		return report, err
+	}
+
+	goPath, err := filepath.Abs(opts.GoPath)
+	if err != nil {
+		return report, err
+	}
+
+	iopts := interp.Options{GoPath: goPath}
+
+	name, err := sourcePackageName(action.Source)
+	if err != nil {
+		return report, err
+	}
+	if name != action.Name {
+		return report, fmt.Errorf("%w: package %s, action %s", ErrPackageName, name, action.Name)
+	}
+
+	if info.IsDir() {
+		report.Package = action.ImportPath
+		if report.Package == "" {
+			report.Package = action.Name
+		}
+
+		source, err := filepath.Abs(action.Source)
+		if err != nil {
+			return report, err
+		}
+
+		iopts.SourcecodeFilesystem = overlayFS{
+			target: filepath.Join(goPath, "src", filepath.FromSlash(report.Package)),
+			source: source,
+		}
+	} else {
+		report.Package = name
+	}
+
+	symbols, err := app.SandboxSymbols(action.Name, goPath, action.Source, action.Capabilities)
+	if err != nil {
+		return report, err
+	}
+
+	env := interp.New(iopts)
+
+	if err := env.Use(symbols); err != nil {
+		return report, err
+	}
+
+	if err := env.Use(New().Exports()); err != nil {
+		return report, err
+	}
+
+	if info.IsDir() {
+		_, err = env.Eval(fmt.Sprintf("import %q", report.Package))
+	} else {
+		_, err = env.EvalPath(action.Source)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	report.Handlers = make([]string, 0)
+	for name, symbol := range env.Symbols(report.Package)[report.Package] {
+
+		if slices.Contains(actionHooks, name) {
+			if _, ok := symbol.Interface().(func() error); !ok {
+				return report, fmt.Errorf("%w: %s", ErrHookType, name)
+			}
+			continue
+		}
+
+		if isHandler(symbol.Interface()) {
+			report.Handlers = append(report.Handlers, name)
+		}
+	}
+
+	if len(report.Handlers) == 0 {
+		return report, ErrNoHandlers
+	}
+
+	slices.Sort(report.Handlers)
+	return report, nil
+}
+
+// The package declared by a go file, or by the go files of a package
+// directory (test files aside)
+func sourcePackageName(source string) (string, error) {
+	files, err := sourceFiles(source)
+	if err != nil {
+		return "", err
+	}
+	return packageName(files[0])
+}
+
+// The go files that make up an action, which may be a single
+// file or a package directory. Test files are not part of it
+func sourceFiles(source string) ([]string, error) {
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{source}, nil
+	}
+
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		files = append(files, filepath.Join(source, name))
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no go files found in %s", source)
+	}
+	return files, nil
+}
+
+// Find the handlers of an action by reading its source, without loading
+// it. Functions are matched to the handler signatures by how they are
+// written, so an action that would fail validation may still list some
+func Handlers(source string) ([]string, error) {
+
+	files, err := sourceFiles(source)
+	if err != nil {
+		return nil, err
+	}
+
+	handlers := make([]string, 0)
+	fset := token.NewFileSet()
+	for _, file := range files {
+
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		// The emrs package may be imported under another name
+		emrs := ""
+		for _, spec := range parsed.Imports {
+			if path, err := strconv.Unquote(spec.Path.Value); err == nil && path == "emrs" {
+				emrs = "emrs"
+				if spec.Name != nil {
+					emrs = spec.Name.Name
+				}
+			}
+		}
+
+		for _, decl := range parsed.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !fn.Name.IsExported() || slices.Contains(actionHooks, fn.Name.Name) {
+				continue
+			}
+			if isHandlerDecl(fn.Type, emrs) {
+				handlers = append(handlers, fn.Name.Name)
+			}
+		}
+	}
+
+	slices.Sort(handlers)
+	return handlers, nil
+}
+
+// Whether a function is written with one of the signatures of isHandler
+func isHandlerDecl(fn *ast.FuncType, emrs string) bool {
+
+	params := fieldTypes(fn.Params)
+	results := fieldTypes(fn.Results)
+
+	event := emrs + ".Event"
+	raw := []string{"string", "[]string", "[]byte"}
+
+	if !slices.Equal(params, raw) && !(emrs != "" && slices.Equal(params, []string{event})) {
+		return false
+	}
+	return slices.Equal(results, []string{"error"}) || slices.Equal(results, []string{"[]byte", "error"})
+}
+
+// The types of a parameter or result list, one for each value
+func fieldTypes(fields *ast.FieldList) []string {
+	list := make([]string, 0)
+	if fields == nil {
+		return list
+	}
+	for _, field := range fields.List {
+		count := max(1, len(field.Names))
+		for i := 0; i < count; i++ {
+			list = append(list, types.ExprString(field.Type))
+		}
+	}
+	return list
+}
+
+// The signatures the runner is able to route events to,
+// including pipeline stages that produce output
+func isHandler(fn interface{}) bool {
+	switch fn.(type) {
+	case func(string, []string, []byte) error:
+		return true
+	case func(app.Event) error:
+		return true
+	case func(string, []string, []byte) ([]byte, error):
+		return true
+	case func(app.Event) ([]byte, error):
+		return true
+	}
+	return false
+}
+
+// Reads paths within `target` from `source` instead,
+// and everything else straight from the disk
+type overlayFS struct {
+	target string
+	source string
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if rel, err := filepath.Rel(o.target, name); err == nil && !strings.HasPrefix(rel, "..") {
+		name = filepath.Join(o.source, rel)
+	}
+	return os.Open(name)
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"errors"
+	"github.com/bosley/emrs/datastore"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Header carrying the API version of a submitter
+const eventVersionHeader = "EMRS-API-Version"
+
+// Handlers may take an event rather than the origin, route and data alone:
+//
+//	func MyHandler(ev emrs.Event) error
+type Event struct {
+	Id       string            // Id of the job delivering the event
+	Origin   string            // Asset id, or what raised the job (action name, schedule:<name>)
+	Asset    string            // Display name of the origin asset, empty if not an asset
+	Route    []string          // Full route, including the action and function
+	Data     []byte            // Raw data submitted with the event
+	Received time.Time         // When the server accepted the event
+	Headers  map[string]string // Headers of the submission, less credentials
+	Version  string            // API version of the submitter, if given
+	Tags     []string          // Tags given with the submission
+
+	// Media type of the data (ex: application/json), if the submission gave one
+	ContentType string
+}
+
+// Request headers that are never handed to actions
+var eventHiddenHeaders = map[string]bool{
+	"Token": true,
+}
+
+// Flatten request headers for an event, leaving out credentials
+func eventHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for key, values := range header {
+		if eventHiddenHeaders[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		headers[key] = strings.Join(values, ", ")
+	}
+	return headers
+}
+
+func (r *yaegiRunner) buildEvent(job *Job) Event {
+
+	ev := Event{
+		Id:       job.Id,
+		Origin:   job.Origin,
+		Route:    append([]string{}, job.Destination...),
+		Data:     job.Data,
+		Received: job.Received,
+		Headers:  make(map[string]string),
+		Version:  job.Version,
+		Tags:     append([]string{}, job.Tags...),
+	}
+
+	for key, value := range job.Headers {
+		ev.Headers[key] = value
+		if http.CanonicalHeaderKey(key) == "Content-Type" {
+			ev.ContentType = mediaType(value)
+		}
+	}
+
+	if r.db != nil {
+		asset, err := r.db.GetAsset(job.Origin)
+		if err == nil {
+			ev.Asset = asset.DisplayName
+		} else if !errors.Is(err, datastore.ErrNotFound) {
+			slog.Warn("unable to retrieve asset for event", "job", job.Id, "origin", job.Origin, "error", err.Error())
+		}
+	}
+	return ev
+}
+
+// Decode the data of an event according to its content type (see payload.go)
+func DecodeEvent(ev Event) (interface{}, error) {
+	return DecodePayload(ev.ContentType, ev.Data)
+}
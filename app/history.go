@@ -0,0 +1,116 @@
+package app
+
+/*
+
+   Every event accepted from an asset is recorded in the datastore
+   along with what became of it, as an audit trail of what each
+   asset has reported. The outcome of an event is pending until
+   every job created for it has succeeded or been dead lettered.
+
+   The submitted data is only kept if configured to be, and then
+   only up to a limit. Events whose data was kept in full can be
+   replayed through the current actions, to backfill after fixing
+   an action or to try a new one against real traffic.
+
+*/
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/bosley/emrs/api"
+	"github.com/bosley/emrs/badger"
+	"github.com/bosley/emrs/datastore"
+)
+
+// Bytes of each event's data kept when payloads are recorded
+const DefaultEventPayloadLimit = 4096
+
+var ErrNoPayload = errors.New("event data was not kept in full")
+
+type EventHistory struct {
+	Payloads   bool // Keep the data submitted with each event
+	MaxPayload int  // Bytes of data kept (DefaultEventPayloadLimit if zero)
+}
+
+// Record an accepted event that is about to be handed to the given number
+// of jobs, returning its id. The headers, version and tags are kept so that
+// a replay hands its jobs the same content type and tags. An empty id is
+// returned if it could not be recorded, which does not stop the event from
+// being handled
+func (a *App) recordEvent(origin string, route []string, data []byte, submission datastore.Submission, jobs int) string {
+
+	id, err := badger.GenerateId()
+	if err != nil {
+		slog.Error("failed to generate event id", "error", err.Error())
+		return ""
+	}
+
+	event := datastore.Event{
+		Id:       id,
+		Origin:   origin,
+		Route:    strings.Join(route, "."),
+		Size:     len(data),
+		Received: submission.Received,
+		Headers:  submission.Headers,
+		Version:  submission.Version,
+		Tags:     submission.Tags,
+		Jobs:     jobs,
+	}
+
+	if a.history.Payloads {
+		limit := a.history.MaxPayload
+		if limit <= 0 {
+			limit = DefaultEventPayloadLimit
+		}
+		event.Payload = append([]byte{}, data[:min(len(data), limit)]...)
+	}
+
+	if err := a.db.AddEvent(event); err != nil {
+		slog.Error("failed to record event", "origin", origin, "route", event.Route, "error", err.Error())
+		return ""
+	}
+	return id
+}
+
+// Submit the jobs for a recorded event again, to the route it was submitted
+// to or the given route, as though the origin had just submitted it. The jobs
+// are given the time the event was originally received. Replays are not
+// recorded as events of their own
+func (a *App) replayEvent(event datastore.Event, route []string) ([]string, error) {
+
+	if len(event.Payload) != event.Size {
+		return nil, ErrNoPayload
+	}
+
+	if len(route) == 0 {
+		var err error
+		if route, err = api.DecomposeRoute(event.Route); err != nil {
+			return nil, err
+		}
+	}
+
+	destinations, routed := a.routes.resolve(route)
+	if !routed {
+		destinations = [][]string{route}
+	}
+
+	jobs := make([]string, 0, len(destinations))
+	for _, destination := range destinations {
+		job := &Job{
+			Origin:      event.Origin,
+			Destination: destination,
+			Data:        event.Payload,
+			Received:    event.Received,
+			Headers:     event.Headers,
+			Version:     event.Version,
+			Tags:        event.Tags,
+		}
+		if err := a.runner.SubmitJob(job); err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job.Id)
+	}
+	return jobs, nil
+}
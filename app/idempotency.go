@@ -0,0 +1,71 @@
+package app
+
+/*
+
+   Assets on unreliable links resubmit events when they don't hear
+   back, and without some way of recognizing a resubmission each
+   one would be handled again. A submission may carry a key that
+   the asset gives to every attempt at the same submission. The
+   first attempt to give a key claims it, and later attempts are
+   answered with the jobs of the first rather than creating any.
+
+   Keys are remembered per asset in the datastore, so they hold
+   across restarts, for a window after they are first given.
+
+   If none of a submission's jobs can be handed to the runner the
+   key is released, so the asset's next attempt is handled afresh.
+   If only some can be, the key keeps them along with the routes of
+   the jobs that are missing, and the next attempt creates only the
+   missing jobs. Claims left by a server that stopped part way
+   through a submission are given up after a short time, rather
+   than holding the key for the whole window.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bosley/emrs/datastore"
+)
+
+// How long an idempotency key is remembered for
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// How long a claim may go without its submission completing
+// before the claim is taken to be abandoned
+const idempotencyClaimTimeout = time.Minute
+
+const maxIdempotencyKeyLength = 256
+
+var ErrBadIdempotencyKey = errors.New("invalid idempotency key")
+
+// Claim a key for a submission from the origin. If the key was already
+// claimed the earlier submission is returned along with false
+func (a *App) claimIdempotencyKey(origin string, key string, now time.Time) (datastore.IdempotencyKey, bool, error) {
+
+	if len(key) > maxIdempotencyKeyLength {
+		return datastore.IdempotencyKey{}, false, fmt.Errorf("%w: longer than %d bytes", ErrBadIdempotencyKey, maxIdempotencyKeyLength)
+	}
+
+	window := a.idempotencyWindow
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+
+	return a.db.ClaimIdempotencyKey(
+		datastore.IdempotencyKey{
+			Origin:  origin,
+			Key:     key,
+			Created: now,
+		},
+		now.Add(-window),
+		now.Add(-idempotencyClaimTimeout))
+}
+
+// Take over creating the jobs missing from a submission
+// made with the key, for a repeat of that submission
+func (a *App) resumeIdempotencyKey(previous datastore.IdempotencyKey, now time.Time) (bool, error) {
+	return a.db.ResumeIdempotencyKey(previous, now, now.Add(-idempotencyClaimTimeout))
+}
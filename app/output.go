@@ -0,0 +1,260 @@
+package app
+
+/*
+
+   Everything an action writes to stdout or stderr, and everything it
+   passes to emrs.Log, is kept in a buffer of recent lines for that
+   action rather than being mixed into the server's own output. The
+   buffer outlives reloads of the action, and may also be appended
+   to a file (<action>.log) in the configured output directory.
+
+   Each line is numbered so that a reader can ask for only the
+   lines written since the last it saw.
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Lines of output kept for each action
+	DefaultActionOutputLines = 1000
+
+	// Output without a newline is broken into lines of this size
+	maxOutputLineSize = 64 * 1024
+)
+
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+	OutputLog    = "log"
+)
+
+type OutputLine struct {
+	Seq    int64
+	Time   time.Time
+	Stream string
+	Text   string
+}
+
+type actionOutput struct {
+	mu    sync.Mutex
+	lines []OutputLine // ring of at most `limit` lines
+	start int          // index of the oldest line
+	limit int
+	seq   int64
+	file  *os.File // nil if not saving to disk
+
+	// Write ends of the pipes handed to the action's interpreters
+	stdout *os.File
+	stderr *os.File
+
+	readers sync.WaitGroup  // copying from the pipes
+	writers []*outputWriter // handed out, to be flushed on close
+}
+
+func newActionOutput(action string, limit int, dir string) *actionOutput {
+
+	if limit <= 0 {
+		limit = DefaultActionOutputLines
+	}
+
+	o := &actionOutput{
+		lines: make([]OutputLine, 0, limit),
+		limit: limit,
+	}
+
+	if dir == "" {
+		return o
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("unable to create action output directory", "dir", dir, "error", err.Error())
+		return o
+	}
+
+	path := filepath.Join(dir, action+".log")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("unable to open action output file", "file", path, "error", err.Error())
+		return o
+	}
+	o.file = file
+	return o
+}
+
+func (o *actionOutput) add(stream string, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.seq++
+	line := OutputLine{
+		Seq:    o.seq,
+		Time:   time.Now(),
+		Stream: stream,
+		Text:   text,
+	}
+
+	if len(o.lines) < o.limit {
+		o.lines = append(o.lines, line)
+	} else {
+		o.lines[o.start] = line
+		o.start = (o.start + 1) % o.limit
+	}
+
+	if o.file != nil {
+		fmt.Fprintf(o.file, "%s [%s] %s\n", line.Time.Format(time.RFC3339), stream, text)
+	}
+}
+
+// Lines with a sequence number greater than `after`, oldest first
+func (o *actionOutput) since(after int64) []OutputLine {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	result := make([]OutputLine, 0)
+	for i := range len(o.lines) {
+		line := o.lines[(o.start+i)%len(o.lines)]
+		if line.Seq > after {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// The streams to hand to an interpreter as its stdout and stderr. They
+// are files (pipes read into the buffer) rather than plain writers, as the
+// interpreter only redirects os.Stdout and os.Stderr to files. Without
+// pipes only print, println and the fmt.Print family are captured
+func (o *actionOutput) streams() (io.Writer, io.Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.stdout == nil {
+		o.stdout = o.pipe(OutputStdout)
+	}
+	if o.stderr == nil {
+		o.stderr = o.pipe(OutputStderr)
+	}
+
+	var stdout, stderr io.Writer
+	if o.stdout != nil {
+		stdout = o.stdout
+	} else {
+		stdout = o.handOut(OutputStdout)
+	}
+	if o.stderr != nil {
+		stderr = o.stderr
+	} else {
+		stderr = o.handOut(OutputStderr)
+	}
+	return stdout, stderr
+}
+
+// A writer for the stream that is flushed when the output is closed
+func (o *actionOutput) handOut(stream string) *outputWriter {
+	w := o.writer(stream)
+	o.writers = append(o.writers, w)
+	return w
+}
+
+func (o *actionOutput) pipe(stream string) *os.File {
+	read, write, err := os.Pipe()
+	if err != nil {
+		slog.Error("unable to create pipe for action output", "stream", stream, "error", err.Error())
+		return nil
+	}
+	o.readers.Add(1)
+	go func() {
+		defer o.readers.Done()
+		w := o.writer(stream)
+		io.Copy(w, read)
+		w.flush()
+		read.Close()
+	}()
+	return write
+}
+
+// Close the pipes and keep whatever was written to them, including a last
+// line without a newline, before closing the file
+func (o *actionOutput) close() {
+	o.mu.Lock()
+	pipes := []*os.File{o.stdout, o.stderr}
+	writers := o.writers
+	o.stdout, o.stderr, o.writers = nil, nil, nil
+	o.mu.Unlock()
+
+	for _, f := range pipes {
+		if f != nil {
+			f.Close()
+		}
+	}
+	o.readers.Wait()
+
+	for _, w := range writers {
+		w.flush()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+}
+
+// A writer for one of the action's streams, handed to its interpreter.
+// Writes are split into lines, holding on to any unfinished line until
+// the rest of it is written
+type outputWriter struct {
+	mu      sync.Mutex
+	output  *actionOutput
+	stream  string
+	partial []byte
+}
+
+func (o *actionOutput) writer(stream string) *outputWriter {
+	return &outputWriter{
+		output: o,
+		stream: stream,
+	}
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.output.add(w.stream, string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	for len(w.partial) >= maxOutputLineSize {
+		w.output.add(w.stream, string(w.partial[:maxOutputLineSize]))
+		w.partial = w.partial[maxOutputLineSize:]
+	}
+	return len(p), nil
+}
+
+// Keep an unfinished line as it is, as nothing more will be written to it
+func (w *outputWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.output.add(w.stream, string(w.partial))
+		w.partial = nil
+	}
+}
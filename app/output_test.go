@@ -0,0 +1,94 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestActionOutputRing(t *testing.T) {
+
+	output := newActionOutput("test", 3, "")
+
+	for i := range 5 {
+		output.add(OutputLog, fmt.Sprint(i))
+	}
+
+	lines := output.since(0)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines to be kept, got %d", len(lines))
+	}
+	for i, line := range lines {
+		if line.Seq != int64(i+3) || line.Text != fmt.Sprint(i+2) {
+			t.Fatalf("unexpected line %d: %+v", i, line)
+		}
+	}
+
+	if lines := output.since(4); len(lines) != 1 || lines[0].Seq != 5 {
+		t.Fatalf("expected only the newest line, got %+v", lines)
+	}
+	if lines := output.since(5); len(lines) != 0 {
+		t.Fatalf("expected no lines, got %+v", lines)
+	}
+}
+
+func TestOutputWriterLines(t *testing.T) {
+
+	output := newActionOutput("test", 10, "")
+	writer := output.writer(OutputStdout)
+
+	writer.Write([]byte("first\nsec"))
+	writer.Write([]byte("ond\n"))
+	writer.Write([]byte("unfinished"))
+
+	lines := output.since(0)
+	if len(lines) != 2 || lines[0].Text != "first" || lines[1].Text != "second" {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+	if lines[0].Stream != OutputStdout {
+		t.Fatalf("unexpected stream: %s", lines[0].Stream)
+	}
+
+	writer.Write([]byte(strings.Repeat("x", maxOutputLineSize)))
+	lines = output.since(2)
+	if len(lines) != 1 || len(lines[0].Text) != maxOutputLineSize {
+		t.Fatalf("expected a long line to be broken up, got %d lines", len(lines))
+	}
+}
+
+func TestActionOutputClose(t *testing.T) {
+
+	dir := t.TempDir()
+	output := newActionOutput("test", 10, dir)
+	stdout, stderr := output.streams()
+
+	fmt.Fprint(stdout, "done\nlast")
+	fmt.Fprint(stderr, "unfinished")
+
+	// Lines without a newline are kept once nothing more can be written
+	output.close()
+
+	texts := make(map[string]string)
+	for _, line := range output.since(0) {
+		texts[line.Text] = line.Stream
+	}
+	expected := map[string]string{"done": OutputStdout, "last": OutputStdout, "unfinished": OutputStderr}
+	if len(texts) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, texts)
+	}
+	for text, stream := range expected {
+		if texts[text] != stream {
+			t.Fatalf("expected %q on %s, got %v", text, stream, texts)
+		}
+	}
+
+	saved, err := os.ReadFile(filepath.Join(dir, "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), "[stdout] last") || !strings.Contains(string(saved), "[stderr] unfinished") {
+		t.Fatalf("expected the last lines to be saved, got %q", saved)
+	}
+}
@@ -0,0 +1,185 @@
+package app
+
+/*
+
+   Submitted data is checked against its Content-Type as it is read,
+   so that malformed payloads are refused at ingest rather than left
+   for handlers to trip over. Bodies compressed with gzip are expanded
+   first, and handlers always receive the expanded data.
+
+      application/json         must be valid JSON
+      application/cbor         must be a single CBOR item
+      application/x-msgpack    must be a single MessagePack item
+      text/plain               must be UTF-8
+
+   Anything else is taken as raw bytes. Actions decode payloads with
+   emrs.Decode(ev), or emrs.DecodeJSON(data) and friends.
+
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	ContentJSON    = "application/json"
+	ContentCBOR    = "application/cbor"
+	ContentMsgpack = "application/x-msgpack"
+	ContentText    = "text/plain"
+)
+
+// Largest body accepted with a submission, after it is expanded
+const DefaultMaxBodySize = 1 << 20
+
+var (
+	ErrBodyTooLarge        = errors.New("body exceeds the maximum size")
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrMalformedPayload    = errors.New("payload does not match its content type")
+)
+
+var (
+	cborHandle    = &codec.CborHandle{}
+	msgpackHandle = &codec.MsgpackHandle{}
+)
+
+func init() {
+	// Maps are decoded with string keys, as they would be from JSON
+	mapType := reflect.TypeOf(map[string]interface{}(nil))
+	cborHandle.MapType = mapType
+	msgpackHandle.MapType = mapType
+	msgpackHandle.RawToString = true
+}
+
+// The media type of a Content-Type header, without parameters.
+// Values that can't be parsed are given back as they are
+func mediaType(contentType string) string {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.TrimSpace(contentType)
+	}
+	return media
+}
+
+// Read the body of a submission, expanding it if it was compressed and
+// checking it against its content type. At most `limit` bytes are read
+func readPayload(request *http.Request, limit int64) ([]byte, error) {
+
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+
+	var body io.Reader = request.Body
+	compressed := false
+
+	switch encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		raw, err := io.ReadAll(io.LimitReader(body, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(raw)) > limit {
+			return nil, ErrBodyTooLarge
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, err.Error())
+		}
+		defer reader.Close()
+		body = reader
+		compressed = true
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		// The compressed body is already in memory, so
+		// errors expanding it are errors in the data
+		if compressed {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, err.Error())
+		}
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+
+	if err := validatePayload(mediaType(request.Header.Get("Content-Type")), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Payloads of the known content types must decode. An empty
+// payload is no payload at all, and is always accepted
+func validatePayload(contentType string, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if contentType == ContentText {
+		if !utf8.Valid(data) {
+			return fmt.Errorf("%w: %s is not UTF-8", ErrMalformedPayload, contentType)
+		}
+		return nil
+	}
+	_, err := DecodePayload(contentType, data)
+	return err
+}
+
+// Decode data of the given content type. Text is given as a string,
+// and types that aren't known are given back as raw bytes
+func DecodePayload(contentType string, data []byte) (interface{}, error) {
+	switch mediaType(contentType) {
+	case ContentJSON:
+		return DecodeJSON(data)
+	case ContentCBOR:
+		return DecodeCBOR(data)
+	case ContentMsgpack:
+		return DecodeMsgpack(data)
+	case ContentText:
+		return string(data), nil
+	}
+	return data, nil
+}
+
+func DecodeJSON(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, err.Error())
+	}
+	return value, nil
+}
+
+func DecodeCBOR(data []byte) (interface{}, error) {
+	return decodeWith(cborHandle, data)
+}
+
+func DecodeMsgpack(data []byte) (interface{}, error) {
+	return decodeWith(msgpackHandle, data)
+}
+
+// Decode a single item, refusing anything trailing it
+func decodeWith(handle codec.Handle, data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := codec.NewDecoderBytes(data, handle)
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, err.Error())
+	}
+	if decoder.NumBytesRead() != len(data) {
+		return nil, fmt.Errorf("%w: unexpected data after the payload", ErrMalformedPayload)
+	}
+	return value, nil
+}
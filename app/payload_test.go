@@ -0,0 +1,113 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func payloadRequest(contentType string, encoding string, body []byte) ([]byte, error) {
+	request := httptest.NewRequest("POST", "/submit/event", bytes.NewReader(body))
+	request.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	return readPayload(request, 64)
+}
+
+func encodeWith(t *testing.T, handle codec.Handle, value interface{}) []byte {
+	var encoded []byte
+	if err := codec.NewEncoderBytes(&encoded, handle).Encode(value); err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestReadPayload(t *testing.T) {
+
+	reading := map[string]interface{}{"temp": 21.5}
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        []byte
+		err         error
+	}{
+		{"json", "application/json; charset=utf-8", []byte(`{"temp": 21.5}`), nil},
+		{"bad json", ContentJSON, []byte(`{"temp": `), ErrMalformedPayload},
+		{"cbor", ContentCBOR, encodeWith(t, cborHandle, reading), nil},
+		{"bad cbor", ContentCBOR, []byte{0xbf, 0x61}, ErrMalformedPayload},
+		{"trailing cbor", ContentCBOR, append(encodeWith(t, cborHandle, reading), 0x01), ErrMalformedPayload},
+		{"msgpack", ContentMsgpack, encodeWith(t, msgpackHandle, reading), nil},
+		{"bad msgpack", ContentMsgpack, []byte{0x81, 0xa4}, ErrMalformedPayload},
+		{"text", ContentText, []byte("21.5"), nil},
+		{"bad text", ContentText, []byte{0xff, 0xfe}, ErrMalformedPayload},
+		{"raw", "octet-stream", []byte{0xff, 0xfe}, nil},
+		{"empty json", ContentJSON, []byte{}, nil},
+		{"too large", ContentText, bytes.Repeat([]byte("a"), 65), ErrBodyTooLarge},
+	}
+
+	for _, c := range cases {
+		data, err := payloadRequest(c.contentType, "", c.body)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("%s: expected error %v, got %v", c.name, c.err, err)
+		}
+		if err == nil && !bytes.Equal(data, c.body) {
+			t.Fatalf("%s: data changed to %q", c.name, data)
+		}
+	}
+}
+
+func TestReadPayloadGzip(t *testing.T) {
+
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte(`{"temp": 21.5}`))
+	writer.Close()
+
+	data, err := payloadRequest(ContentJSON, "gzip", compressed.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"temp": 21.5}` {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	// Expanded data is held to the limit as well
+	compressed.Reset()
+	writer = gzip.NewWriter(compressed)
+	writer.Write(bytes.Repeat([]byte("a"), 1024))
+	writer.Close()
+
+	if _, err := payloadRequest(ContentText, "gzip", compressed.Bytes()); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrBodyTooLarge, err)
+	}
+
+	if _, err := payloadRequest(ContentJSON, "gzip", []byte("not gzip")); !errors.Is(err, ErrMalformedPayload) {
+		t.Fatalf("expected %v, got %v", ErrMalformedPayload, err)
+	}
+
+	if _, err := payloadRequest(ContentJSON, "br", []byte("{}")); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedEncoding, err)
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+
+	value, err := DecodeEvent(Event{
+		ContentType: ContentMsgpack,
+		Data:        encodeWith(t, msgpackHandle, map[string]interface{}{"door": "open"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, ok := value.(map[string]interface{})
+	if !ok || fields["door"] != "open" {
+		t.Fatalf("unexpected value %#v", value)
+	}
+}
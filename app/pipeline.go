@@ -0,0 +1,118 @@
+package app
+
+/*
+
+   A pipeline is a named list of handlers, each of which is handed
+   the output of the one before it:
+
+      ingest: [decode.Json, enrich.Asset, alert.Threshold]
+
+   Jobs are sent to a pipeline by route the same way they are sent
+   to an action, with the pipeline's name first (ingest.anything).
+   Any sections after the name are appended to each stage's route.
+   The whole pipeline runs as one job, so a failing stage fails the
+   job and a retry starts again from the first stage.
+
+   Stages are handlers that return their output along with the error:
+
+      func Json(origin string, route []string, data []byte) ([]byte, error)
+      func Asset(ev emrs.Event) ([]byte, error)
+
+   Plain handlers may be used as stages too, in which case their
+   input is handed on to the next stage unchanged. A stage returning
+   emrs.Halt ends the pipeline early without failing the job.
+
+   A pipeline can not share its name with an action, and actions under
+   a concurrency limit can't be stages, as the pipeline's job runs each
+   stage without taking a place under the stage action's limit. A job
+   failing in a stage is retried under the retry policy of the stage,
+   unless the pipeline has a policy of its own.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/bosley/emrs/api"
+)
+
+var ErrInvalidPipeline = errors.New("invalid pipeline")
+
+// Returned by a stage to end its pipeline without error
+var ErrHalt = errors.New("pipeline halted")
+
+// A stage of a pipeline that failed, and why
+type stageError struct {
+	destination []string
+	err         error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// Pipelines are checked against the installed actions
+// and the concurrency limits given to them
+func buildPipelines(pipelines map[string][]string, actions map[string]string, limits map[string]Concurrency) (map[string][][]string, error) {
+
+	result := make(map[string][][]string, len(pipelines))
+
+	for name, stages := range pipelines {
+
+		if !api.ValidateCommonChunk(name) {
+			return nil, fmt.Errorf("%w: bad name '%s'", ErrInvalidPipeline, name)
+		}
+
+		if _, ok := actions[name]; ok {
+			return nil, fmt.Errorf("%w: %s is also the name of an action", ErrInvalidPipeline, name)
+		}
+
+		if len(stages) == 0 {
+			return nil, fmt.Errorf("%w: %s has no stages", ErrInvalidPipeline, name)
+		}
+
+		for _, stage := range stages {
+			destination, err := scheduleDestination(stage)
+			if err != nil {
+				slog.Error("invalid stage given to pipeline", "pipeline", name, "stage", stage)
+				return nil, fmt.Errorf("%w: %s: stage '%s': %s", ErrInvalidPipeline, name, stage, err.Error())
+			}
+			if limit, ok := limits[destination[0]]; ok && limit.Limit > 0 {
+				return nil, fmt.Errorf("%w: %s: stage '%s': action %s has a concurrency limit", ErrInvalidPipeline, name, stage, destination[0])
+			}
+			result[name] = append(result[name], destination)
+		}
+	}
+	return result, nil
+}
+
+func (r *yaegiRunner) runPipeline(job *Job, name string, stages [][]string) error {
+
+	data := job.Data
+	for i, stage := range stages {
+
+		destination := append(append([]string{}, stage...), job.Destination[1:]...)
+
+		slog.Debug("running pipeline stage", "pipeline", name, "stage", i, "to", destination)
+
+		output, err := r.callHandler(job, destination, data)
+		if errors.Is(err, ErrHalt) {
+			slog.Info("pipeline halted", "pipeline", name, "stage", i, "job", job.Id)
+			return nil
+		}
+		if err != nil {
+			return &stageError{
+				destination: destination,
+				err:         fmt.Errorf("pipeline %s stage %d: %w", name, i, err),
+			}
+		}
+		data = output
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBuildPipelines(t *testing.T) {
+
+	pipelines, err := buildPipelines(map[string][]string{
+		"ingest": {"decode.Json", "enrich.Asset", "alert.Threshold.high"},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"decode", "Json"},
+		{"enrich", "Asset"},
+		{"alert", "Threshold", "high"},
+	}
+	if !reflect.DeepEqual(pipelines["ingest"], expected) {
+		t.Fatalf("expected %v, got %v", expected, pipelines["ingest"])
+	}
+
+	invalid := []map[string][]string{
+		{"ingest": {}},
+		{"ingest": {"decode"}},
+		{"ingest": {"decode.Json", "enrich.As-set"}},
+		{"in.gest": {"decode.Json"}},
+	}
+
+	for _, pipelines := range invalid {
+		if _, err := buildPipelines(pipelines, nil, nil); !errors.Is(err, ErrInvalidPipeline) {
+			t.Fatalf("expected %v to be invalid, got %v", pipelines, err)
+		}
+	}
+
+	// Pipelines can't take an action's name
+	actions := map[string]string{"decode": "decode.go", "ingest": "ingest.go"}
+	if _, err := buildPipelines(map[string][]string{"ingest": {"decode.Json"}}, actions, nil); !errors.Is(err, ErrInvalidPipeline) {
+		t.Fatalf("expected a pipeline named after an action to be invalid, got %v", err)
+	}
+
+	// Nor use limited actions as stages
+	limits := map[string]Concurrency{"decode": {Limit: 1}}
+	if _, err := buildPipelines(map[string][]string{"ingest": {"decode.Json"}}, nil, limits); !errors.Is(err, ErrInvalidPipeline) {
+		t.Fatalf("expected a limited stage to be invalid, got %v", err)
+	}
+}
+
+func TestPipelineRetryPolicy(t *testing.T) {
+
+	r := &yaegiRunner{
+		retries: retryPolicies{
+			fallback: RetryPolicy{Attempts: 1},
+			routes: map[string]RetryPolicy{
+				"enrich": {Attempts: 5},
+				"audit":  {Attempts: 7},
+			},
+		},
+	}
+
+	failed := &stageError{destination: []string{"enrich", "Asset"}, err: errors.New("failed")}
+
+	cases := []struct {
+		destination []string
+		err         error
+		attempts    int
+	}{
+		{[]string{"ingest"}, failed, 5},
+		{[]string{"audit"}, failed, 7},
+		{[]string{"ingest"}, errors.New("failed"), 1},
+	}
+
+	for _, c := range cases {
+		if policy := r.retryPolicy(&Job{Destination: c.destination}, c.err); policy.Attempts != c.attempts {
+			t.Fatalf("%v: expected %d attempts, got %d", c.destination, c.attempts, policy.Attempts)
+		}
+	}
+}
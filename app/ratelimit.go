@@ -0,0 +1,137 @@
+package app
+
+/*
+
+   Submissions are rate limited per asset with token buckets, so that
+   a misbehaving asset can't flood the runner. Each bucket holds up to
+   `Burst` submissions and refills at `Rate` submissions a second.
+
+   Limits are keyed by route prefix like retry policies, so a limit
+   can be given to every route (the default), an entire action, or a
+   single route. The longest matching prefix wins, and each asset has
+   its own bucket for it. Limits set for an asset in the datastore
+   take precedence over the configured limits for the same prefix.
+
+   A rate of zero is no limit at all.
+
+*/
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RateLimit struct {
+	Rate  float64 // Submissions per second (<= 0 is unlimited)
+	Burst int     // Submissions that may be made at once, at least 1 (Rate rounded up if zero)
+}
+
+type RateLimits struct {
+	Default RateLimit
+	Routes  map[string]RateLimit // Keyed by route prefix
+}
+
+func (l RateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return max(1, math.Ceil(l.Rate))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	limits RateLimits
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	throttled atomic.Uint64
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	if limits.Routes == nil {
+		limits.Routes = make(map[string]RateLimit)
+	}
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Retrieve the limit for the longest prefix of the route that has one,
+// along with that prefix. Overrides are keyed the same way, with the
+// asset-wide override under the empty prefix
+func (r *rateLimiter) lookup(route []string, overrides map[string]RateLimit) (string, RateLimit) {
+	for i := len(route); i > 0; i-- {
+		prefix := strings.Join(route[:i], ".")
+		if limit, ok := overrides[prefix]; ok {
+			return prefix, limit
+		}
+		if limit, ok := r.limits.Routes[prefix]; ok {
+			return prefix, limit
+		}
+	}
+	if limit, ok := overrides[""]; ok {
+		return "", limit
+	}
+	return "", r.limits.Default
+}
+
+// Take a submission from the origin's bucket for the route. If the bucket
+// is empty, the time until it will hold a submission again is returned
+func (r *rateLimiter) allow(origin string, route []string, overrides map[string]RateLimit, now time.Time) (time.Duration, bool) {
+
+	prefix, limit := r.lookup(route, overrides)
+	if limit.Rate <= 0 {
+		return 0, true
+	}
+
+	capacity := limit.capacity()
+	key := origin + "\x00" + prefix
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		r.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * limit.Rate
+		b.last = now
+	}
+	b.tokens = min(b.tokens, capacity)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	r.throttled.Add(1)
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+}
+
+// The limits set for an asset in the datastore, keyed by route prefix
+func (a *App) assetRateLimits(origin string) map[string]RateLimit {
+	overrides := make(map[string]RateLimit)
+	limits, err := a.db.GetRateLimits(origin)
+	if err != nil {
+		return overrides
+	}
+	for _, limit := range limits {
+		overrides[limit.Route] = RateLimit{
+			Rate:  limit.Rate,
+			Burst: limit.Burst,
+		}
+	}
+	return overrides
+}
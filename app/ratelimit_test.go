@@ -0,0 +1,92 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+
+	limiter := newRateLimiter(RateLimits{
+		Default: RateLimit{Rate: 2, Burst: 3},
+	})
+
+	now := time.Now()
+	route := []string{"door", "Open"}
+
+	for i := 0; i < 3; i++ {
+		if _, ok := limiter.allow("a", route, nil, now); !ok {
+			t.Fatalf("submission %d within the burst was refused", i)
+		}
+	}
+
+	wait, ok := limiter.allow("a", route, nil, now)
+	if ok {
+		t.Fatal("submission over the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %s", wait)
+	}
+
+	// Each asset has its own bucket
+	if _, ok := limiter.allow("b", route, nil, now); !ok {
+		t.Fatal("another asset was throttled")
+	}
+
+	if _, ok := limiter.allow("a", route, nil, now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("submission refused after the bucket refilled")
+	}
+
+	if n := limiter.throttled.Load(); n != 1 {
+		t.Fatalf("expected 1 throttled submission, got %d", n)
+	}
+}
+
+func TestRateLimiterLookup(t *testing.T) {
+
+	limiter := newRateLimiter(RateLimits{
+		Default: RateLimit{Rate: 1},
+		Routes: map[string]RateLimit{
+			"door":      {Rate: 2},
+			"door.Open": {Rate: 3},
+		},
+	})
+
+	overrides := map[string]RateLimit{
+		"":     {Rate: 10},
+		"door": {Rate: 20},
+	}
+
+	cases := []struct {
+		route     string
+		overrides map[string]RateLimit
+		prefix    string
+		rate      float64
+	}{
+		{"alert.Sms", nil, "", 1},
+		{"door.Close", nil, "door", 2},
+		{"door.Open.front", nil, "door.Open", 3},
+		{"alert.Sms", overrides, "", 10},
+		{"door.Close", overrides, "door", 20},
+		{"door.Open.front", overrides, "door.Open", 3},
+	}
+
+	for _, c := range cases {
+		prefix, limit := limiter.lookup(strings.Split(c.route, "."), c.overrides)
+		if prefix != c.prefix || limit.Rate != c.rate {
+			t.Fatalf("%s: expected %q at %g, got %q at %g", c.route, c.prefix, c.rate, prefix, limit.Rate)
+		}
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+
+	limiter := newRateLimiter(RateLimits{})
+
+	for i := 0; i < 100; i++ {
+		if _, ok := limiter.allow("a", []string{"door"}, nil, time.Now()); !ok {
+			t.Fatal("submission refused without a limit")
+		}
+	}
+}
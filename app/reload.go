@@ -0,0 +1,125 @@
+package app
+
+/*
+
+   Installed actions can be reloaded while the server is running,
+   either on request (CNC) or by watching the action sources for
+   changes. The action map is re-read from the configuration each
+   time so that newly installed actions are picked up as well, as
+   are actions being disabled or enabled.
+
+*/
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Re-read the action map and reload any action that changed
+func (a *App) reloadActions() ([]string, error) {
+
+	actionMap, disabled, err := a.currentActionMap()
+	if err != nil {
+		slog.Error("failed to retrieve action map for reload", "error", err.Error())
+		return nil, err
+	}
+
+	reloaded, err := a.reloadActionMap(actionMap, disabled)
+	if err != nil {
+		slog.Error("failed to reload actions; keeping previously loaded actions", "error", err.Error())
+		return nil, err
+	}
+	return reloaded, nil
+}
+
+// Retrieve the action map along with the actions that are disabled.
+// A nil set of disabled actions leaves the runner's set as it is
+func (a *App) currentActionMap() (map[string]string, []string, error) {
+	var disabled []string
+	if a.loadDisabled != nil {
+		var err error
+		if disabled, err = a.loadDisabled(); err != nil {
+			return nil, nil, err
+		}
+		if disabled == nil {
+			disabled = []string{}
+		}
+	}
+
+	if a.loadActionMap == nil {
+		return a.actionMap, disabled, nil
+	}
+	actionMap, err := a.loadActionMap()
+	return actionMap, disabled, err
+}
+
+func (a *App) reloadActionMap(actionMap map[string]string, disabled []string) ([]string, error) {
+	if disabled != nil {
+		a.runner.SetDisabled(disabled)
+	}
+	return a.runner.Reload(actionMap)
+}
+
+// Poll the action sources, reloading whenever they change. A failed
+// reload is logged and not attempted again until the sources change
+func (a *App) watchActions(interval time.Duration) {
+
+	slog.Info("watching actions for changes", "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	actionMap, disabled, _ := a.currentActionMap()
+	previous := actionFingerprint(actionMap, disabled)
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		actionMap, disabled, err := a.currentActionMap()
+		if err != nil {
+			continue
+		}
+
+		current := actionFingerprint(actionMap, disabled)
+		if current == previous {
+			continue
+		}
+		previous = current
+
+		slog.Info("action changes detected; reloading")
+
+		if _, err := a.reloadActionMap(actionMap, disabled); err != nil {
+			slog.Error("failed to reload actions; keeping previously loaded actions", "error", err.Error())
+		}
+	}
+}
+
+// Summarize the actions named in the map along with the state of their
+// sources and which are disabled, such that any change to them produces
+// a different result
+func actionFingerprint(actionMap map[string]string, disabled []string) string {
+
+	names := make([]string, 0, len(actionMap))
+	for name := range actionMap {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		modTime, _ := actionModTime(actionMap[name])
+		fmt.Fprintf(&b, "%s=%s@%d;", name, actionMap[name], modTime.UnixNano())
+	}
+
+	disabled = slices.Clone(disabled)
+	slices.Sort(disabled)
+	fmt.Fprintf(&b, "disabled=%s", strings.Join(disabled, ","))
+	return b.String()
+}
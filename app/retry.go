@@ -0,0 +1,85 @@
+package app
+
+/*
+
+   Retry policies decide how many times a failing job is attempted,
+   and how long to wait between attempts. The delay starts at the
+   policy's backoff and doubles with each attempt, up to MaxBackoff.
+
+   Policies are keyed by route prefix, so a policy can be given to
+   an entire action (alert) or to a single route (alert.Sms.warn).
+   The longest matching prefix wins. Jobs that use every attempt
+   without success are moved to the dead letter store.
+
+*/
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetryBackoff    = time.Second
+	DefaultRetryMaxBackoff = time.Minute
+)
+
+type RetryPolicy struct {
+	Attempts   int           // Total number of times a job is attempted (<= 1 means no retries)
+	Backoff    time.Duration // Delay before the first retry
+	MaxBackoff time.Duration // Upper bound on the delay between attempts
+}
+
+// Delay to wait before the next attempt, given the
+// number of attempts that have already been made
+func (p RetryPolicy) delay(attempts int) time.Duration {
+
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	limit := p.MaxBackoff
+	if limit <= 0 {
+		limit = DefaultRetryMaxBackoff
+	}
+
+	for i := 1; i < attempts && backoff < limit; i++ {
+		backoff *= 2
+	}
+	return min(backoff, limit)
+}
+
+type retryPolicies struct {
+	fallback RetryPolicy
+	routes   map[string]RetryPolicy
+}
+
+func newRetryPolicies(fallback RetryPolicy, routes map[string]RetryPolicy) retryPolicies {
+	if routes == nil {
+		routes = make(map[string]RetryPolicy)
+	}
+	return retryPolicies{
+		fallback: fallback,
+		routes:   routes,
+	}
+}
+
+// Retrieve the policy for the longest route prefix of the destination
+// that has one, or the fallback policy if none do
+func (p retryPolicies) lookup(destination []string) RetryPolicy {
+	if policy, ok := p.find(destination); ok {
+		return policy
+	}
+	return p.fallback
+}
+
+// Retrieve the policy for the longest route prefix of the
+// destination, if it has one
+func (p retryPolicies) find(destination []string) (RetryPolicy, bool) {
+	for i := len(destination); i > 0; i-- {
+		if policy, ok := p.routes[strings.Join(destination[:i], ".")]; ok {
+			return policy, true
+		}
+	}
+	return RetryPolicy{}, false
+}
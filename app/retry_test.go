@@ -0,0 +1,58 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+
+	policy := RetryPolicy{
+		Attempts:   5,
+		Backoff:    time.Second,
+		MaxBackoff: 5 * time.Second,
+	}
+
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}
+
+	for i, e := range expected {
+		if d := policy.delay(i + 1); d != e {
+			t.Fatalf("attempt %d: expected delay %s, got %s", i+1, e, d)
+		}
+	}
+}
+
+func TestRetryPolicyLookup(t *testing.T) {
+
+	fallback := RetryPolicy{Attempts: 1}
+	action := RetryPolicy{Attempts: 2}
+	route := RetryPolicy{Attempts: 3}
+
+	policies := newRetryPolicies(fallback, map[string]RetryPolicy{
+		"alert":     action,
+		"alert.Sms": route,
+	})
+
+	tcs := []struct {
+		destination []string
+		expected    RetryPolicy
+	}{
+		{[]string{"logger", "Log"}, fallback},
+		{[]string{"alert", "Email"}, action},
+		{[]string{"alert", "Sms"}, route},
+		{[]string{"alert", "Sms", "warn", "twilio"}, route},
+		{[]string{"alertx", "Sms"}, fallback},
+	}
+
+	for _, tc := range tcs {
+		if p := policies.lookup(tc.destination); p != tc.expected {
+			t.Fatalf("destination %v: expected %+v, got %+v", tc.destination, tc.expected, p)
+		}
+	}
+}
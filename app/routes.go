@@ -0,0 +1,156 @@
+package app
+
+/*
+
+   The routing table maps the routes that assets submit to the
+   internal `action.Function` routes that handle them, so that
+   actions can be reorganized without changing what assets send.
+
+      temp.high:  [alert.Sms.warn.twilio]
+      door.open:  [alert.Sms, logger.Log]      (fan-out)
+      sensors.*:  [logger.Log]                 (wildcard)
+      raw.*:      [ingest]                     (pipeline)
+
+   A `*` chunk matches any single chunk, or when it is the last
+   chunk of a pattern, every remaining chunk (at least one). The
+   chunks matched by wildcards are appended to each target, so
+   `sensors.temp.kitchen` above is handled by logger.Log with the
+   route [temp kitchen].
+
+   When more than one pattern matches a route, the most specific
+   (the most literal chunks, then the longest) is used. Routes that
+   match nothing are taken to be `action.Function` routes as they
+   always have been.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/bosley/emrs/api"
+)
+
+const routeWildcard = "*"
+
+var ErrInvalidRouteEntry = errors.New("invalid routing table entry")
+
+type routeEntry struct {
+	pattern  []string
+	targets  [][]string
+	literals int // Chunks that are not wildcards
+}
+
+type routeTable struct {
+	entries []*routeEntry // Most specific first
+}
+
+// Targets are `action.Function` routes, or the names of pipelines
+func buildRouteTable(routes map[string][]string, pipelines map[string][][]string) (*routeTable, error) {
+
+	table := &routeTable{
+		entries: make([]*routeEntry, 0, len(routes)),
+	}
+
+	for pattern, targets := range routes {
+
+		entry := &routeEntry{
+			pattern: strings.Split(pattern, "."),
+		}
+
+		for _, chunk := range entry.pattern {
+			if chunk == routeWildcard {
+				continue
+			}
+			if !api.ValidateCommonChunk(chunk) {
+				return nil, fmt.Errorf("%w: bad chunk '%s' in pattern '%s'", ErrInvalidRouteEntry, chunk, pattern)
+			}
+			entry.literals++
+		}
+
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("%w: '%s' has no targets", ErrInvalidRouteEntry, pattern)
+		}
+
+		for _, target := range targets {
+			if _, ok := pipelines[target]; ok {
+				entry.targets = append(entry.targets, []string{target})
+				continue
+			}
+
+			destination, err := scheduleDestination(target)
+			if err != nil {
+				slog.Error("invalid target given in routing table", "pattern", pattern, "target", target)
+				return nil, fmt.Errorf("%w: '%s' -> '%s': %s", ErrInvalidRouteEntry, pattern, target, err.Error())
+			}
+			entry.targets = append(entry.targets, destination)
+		}
+
+		table.entries = append(table.entries, entry)
+	}
+
+	slices.SortFunc(table.entries, func(a, b *routeEntry) int {
+		if a.literals != b.literals {
+			return b.literals - a.literals
+		}
+		if len(a.pattern) != len(b.pattern) {
+			return len(b.pattern) - len(a.pattern)
+		}
+		return strings.Compare(strings.Join(a.pattern, "."), strings.Join(b.pattern, "."))
+	})
+	return table, nil
+}
+
+// The destinations for a submitted route, or false if
+// the table has nothing to say about the route
+func (t *routeTable) resolve(route []string) ([][]string, bool) {
+
+	for _, entry := range t.entries {
+		captured, ok := entry.match(route)
+		if !ok {
+			continue
+		}
+
+		destinations := make([][]string, 0, len(entry.targets))
+		for _, target := range entry.targets {
+			destination := slices.Concat(target, captured)
+			destinations = append(destinations, destination)
+		}
+		return destinations, true
+	}
+	return nil, false
+}
+
+// Match the route against the pattern, returning the chunks
+// that were matched by wildcards
+func (e *routeEntry) match(route []string) ([]string, bool) {
+
+	captured := make([]string, 0)
+
+	for i, chunk := range e.pattern {
+		if i >= len(route) {
+			return nil, false
+		}
+
+		if chunk != routeWildcard {
+			if chunk != route[i] {
+				return nil, false
+			}
+			continue
+		}
+
+		// A trailing wildcard takes the rest of the route
+		if i == len(e.pattern)-1 {
+			return append(captured, route[i:]...), true
+		}
+		captured = append(captured, route[i])
+	}
+
+	if len(route) != len(e.pattern) {
+		return nil, false
+	}
+	return captured, true
+}
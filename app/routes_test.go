@@ -0,0 +1,72 @@
+package app
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRouteTable(t *testing.T) {
+
+	table, err := buildRouteTable(map[string][]string{
+		"temp.high":     {"alert.Sms.warn.twilio"},
+		"door.open":     {"alert.Sms", "logger.Log"},
+		"sensors.*":     {"logger.Log"},
+		"sensors.*.raw": {"archive.Store"},
+		"sensors.temp":  {"climate.Reading"},
+		"raw.*":         {"ingest"},
+	}, map[string][][]string{
+		"ingest": {{"decode", "Json"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string][]string{
+		"temp.high":            {"alert.Sms.warn.twilio"},
+		"door.open":            {"alert.Sms", "logger.Log"},
+		"sensors.temp":         {"climate.Reading"},
+		"sensors.humidity":     {"logger.Log.humidity"},
+		"sensors.temp.kitchen": {"logger.Log.temp.kitchen"},
+		"sensors.temp.raw":     {"archive.Store.temp"},
+		"raw.kitchen":          {"ingest.kitchen"},
+	}
+
+	for route, expected := range cases {
+		destinations, ok := table.resolve(strings.Split(route, "."))
+		if !ok {
+			t.Fatalf("expected '%s' to be routed", route)
+		}
+		result := make([]string, 0, len(destinations))
+		for _, destination := range destinations {
+			result = append(result, strings.Join(destination, "."))
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("'%s': expected %v, got %v", route, expected, result)
+		}
+	}
+
+	for _, route := range []string{"temp", "temp.low", "sensors", "door.open.wide", "logger.Log"} {
+		if _, ok := table.resolve(strings.Split(route, ".")); ok {
+			t.Fatalf("expected '%s' not to be routed", route)
+		}
+	}
+}
+
+func TestRouteTableInvalid(t *testing.T) {
+
+	invalid := []map[string][]string{
+		{"temp.high": {}},
+		{"temp.high": {"alert"}},
+		{"temp.hi-gh": {"alert.Sms"}},
+		{"temp..high": {"alert.Sms"}},
+		{"temp.high": {"alert.*"}},
+	}
+
+	for _, routes := range invalid {
+		if _, err := buildRouteTable(routes, nil); !errors.Is(err, ErrInvalidRouteEntry) {
+			t.Fatalf("expected %v to be invalid, got %v", routes, err)
+		}
+	}
+}
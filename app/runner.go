@@ -1,134 +1,1116 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/bosley/emrs/api"
+	"github.com/bosley/emrs/badger"
+	"github.com/bosley/emrs/datastore"
+	"io/fs"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/traefik/yaegi/interp"
-	"github.com/traefik/yaegi/stdlib"
 )
 
 type Job struct {
+	Id          string
 	Origin      string
 	Destination []string
 	Data        []byte
+	Attempts    int
 
-	// Tags []string
+	Received time.Time         // When the job was accepted
+	Headers  map[string]string // Headers of the submission that created the job
+	Version  string            // API version of the submission that created the job
+	Tags     []string          // Tags given with the submission that created the job
+	Event    string            // Id of the recorded event the job was created for, if any
+
+	// Its place in line under its action's concurrency limit, given as
+	// it is queued, and whether it holds a place to run under the limit
+	place  uint64
+	placed bool
+	gated  bool
+}
+
+const (
+	DefaultRunnerQueueSize  = 256
+	DefaultRunnerJobTimeout = 30 * time.Second
+)
+
+var ErrUnknownAction = errors.New("unknown action")
+var ErrQueueFull = errors.New("job queue is full")
+var ErrJobTimeout = errors.New("job exceeded time limit")
+var ErrRunnerStopped = errors.New("runner is shutting down")
+var ErrPackageOutsideActions = errors.New("action package directories must be installed under the actions path")
+
+// Settings for the pool of workers that execute jobs.
+// Any value left at zero will be given a default
+type RunnerOpts struct {
+	Workers    int           // Number of jobs that may execute at once
+	QueueSize  int           // Number of jobs that may wait for a worker
+	JobTimeout time.Duration // Time after which a running job is abandoned
+
+	Retry   RetryPolicy            // Policy for jobs without a more specific one
+	Retries map[string]RetryPolicy // Policies by route prefix (action, action.Function, ..)
+
+	Capabilities map[string][]string // Capabilities by action name (see sandbox.go)
+
+	Concurrency map[string]Concurrency // Limits by action name (see concurrency.go)
+
+	OutputLines int    // Lines of output kept for each action
+	OutputDir   string // Where action output is saved to disk, if anywhere (see output.go)
+
+	Disabled []string // Installed actions that are not to be loaded
 }
 
+// Builds the set of symbols offered to a specific action's interpreter
+type ExportsFn func(action string) interp.Exports
+
 type Runner interface {
-	Load(actionsPath string, actionMap map[string]string, exports interp.Exports) error
+	Load(actionsPath string, actionMap map[string]string, exports ExportsFn) error
+	Reload(actionMap map[string]string) ([]string, error)
+	SetDisabled(names []string)
+	Actions() []string
+	Subscribe(action string, signal string, function string) error
+	Emit(origin string, signal string, data []byte) error
 	SubmitJob(job *Job) error
+	JobStatus(id string) (JobStatus, error)
+	Replay() error
+	RetryDeadLetter(id string) error
+	Shutdown(ctx context.Context) error
+	Log(action string, text string)
+	Output(action string, after int64) ([]OutputLine, error)
 }
 
 type yaegiRunner struct {
-	actions map[string]actionModule
+	mu      sync.RWMutex
+	actions map[string]*actionModule
+	loading map[string]*actionModule
+	outputs map[string]*actionOutput
+
+	reloadMu    sync.Mutex
+	actionsPath string
+	exports     ExportsFn
+	disabled    map[string]bool // Skipped when loading
+
+	// Pipeline name to the destinations of its stages (see pipeline.go)
+	pipelines map[string][][]string
+
+	// Subscriptions listed in the server configuration.
+	// Subscriptions made by actions live on their module
+	signals signalTable
+
+	opts    RunnerOpts
+	queue   chan *Job
+	status  *jobStatusTable
+	retries retryPolicies
+	gates   *concurrencyGates
+
+	// Accepted jobs are journaled here until they finish
+	// so that they can be replayed if the server goes down
+	db datastore.DataStore
+
+	// Closed when shutdown begins. Jobs still queued at that
+	// point stay journaled and are replayed on the next start
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+
+	// Jobs whose abandoned calls are still running (see awaitAbandoned)
+	abandoned sync.WaitGroup
+
+	// Retries waiting to be queued, by job id
+	timersMu sync.Mutex
+	timers   map[string]*time.Timer
+
+	// Held while the outcome of a job is recorded. Once shutdown has
+	// finished with the datastore the runner is detached from it, and
+	// jobs finishing after that are left journaled for the next start
+	books    sync.RWMutex
+	detached bool
 }
 
 type actionModule struct {
-	env *interp.Interpreter
+	env     *interp.Interpreter
+	signals signalTable
+	path    string
+	modTime time.Time
+
+	// Import path the action's package was loaded under. This is the
+	// action name for single files, and the path under actions/src
+	// for package directories
+	pkg string
+
+	// Handler calls still running in the interpreter,
+	// including calls abandoned for exceeding the time limit
+	calls atomic.Int64
+}
+
+func newYaegiRunner(opts RunnerOpts, db datastore.DataStore) *yaegiRunner {
+
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultRunnerQueueSize
+	}
+	if opts.JobTimeout <= 0 {
+		opts.JobTimeout = DefaultRunnerJobTimeout
+	}
+
+	r := &yaegiRunner{
+		actions: make(map[string]*actionModule),
+		loading: make(map[string]*actionModule),
+		outputs: make(map[string]*actionOutput),
+		signals: newSignalTable(),
+		opts:    opts,
+		queue:   make(chan *Job, opts.QueueSize),
+		status:  newJobStatusTable(),
+		retries: newRetryPolicies(opts.Retry, opts.Retries),
+		gates:   newConcurrencyGates(opts.Concurrency),
+		db:      db,
+		stop:    make(chan struct{}),
+		timers:  make(map[string]*time.Timer),
+	}
+
+	r.SetDisabled(opts.Disabled)
+
+	slog.Debug("starting runner", "workers", opts.Workers, "queue", opts.QueueSize, "timeout", opts.JobTimeout)
 
-	// output buffer
-	// input mechanism, etc
+	r.workers.Add(opts.Workers)
+	for range opts.Workers {
+		go r.worker()
+	}
+	return r
 }
 
-func (r *yaegiRunner) Load(actionsPath string, actionMap map[string]string, exports interp.Exports) error {
+func (r *yaegiRunner) Load(actionsPath string, actionMap map[string]string, exports ExportsFn) error {
 	slog.Debug("load runner directory", "actions", len(actionMap))
 
-	r.actions = make(map[string]actionModule)
+	r.actionsPath = actionsPath
+	r.exports = exports
+
+	_, err := r.Reload(actionMap)
+	return err
+}
+
+// Bring the loaded actions in line with the given action map. Actions whose
+// source has changed (or that are new) are evaluated in fresh interpreters,
+// and unchanged actions keep their interpreter. Disabled actions are skipped,
+// unloading them if they were loaded. The new set replaces the old
+// one all at once, and only if every action loaded. Jobs already executing
+// finish on the interpreter they started on. Returns the names of the
+// actions that were (re)loaded
+func (r *yaegiRunner) Reload(actionMap map[string]string) ([]string, error) {
+
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	r.mu.RLock()
+	current := r.actions
+	r.mu.RUnlock()
+
+	next := make(map[string]*actionModule)
+	loaded := make([]string, 0)
 
 	for name, path := range actionMap {
 
-		slog.Debug("loading module", "name", name, "path", path)
+		if r.disabled[name] {
+			slog.Debug("skipping disabled action", "name", name)
+			continue
+		}
+
+		modTime, err := actionModTime(path)
+		if err != nil {
+			slog.Error("unable to stat action source", "name", name, "path", path, "error", err.Error())
+			return nil, err
+		}
+
+		if m, ok := current[name]; ok && m.path == path && m.modTime.Equal(modTime) {
+			next[name] = m
+			continue
+		}
+
+		m, err := r.loadModule(name, path)
+		if err != nil {
+			return nil, err
+		}
+		m.modTime = modTime
+
+		next[name] = m
+		loaded = append(loaded, name)
+	}
+
+	r.mu.Lock()
+	r.actions = next
+	r.mu.Unlock()
+
+	slog.Info("actions loaded", "total", len(next), "reloaded", loaded)
+	return loaded, nil
+}
+
+// Set the actions skipped by the next load. Takes
+// effect when the actions are next (re)loaded
+func (r *yaegiRunner) SetDisabled(names []string) {
+	disabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		disabled[name] = true
+	}
+
+	r.reloadMu.Lock()
+	r.disabled = disabled
+	r.reloadMu.Unlock()
+}
+
+// The names of the currently loaded actions
+func (r *yaegiRunner) Actions() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.actions))
+	for name := range r.actions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (r *yaegiRunner) loadModule(name string, path string) (*actionModule, error) {
+
+	slog.Debug("loading module", "name", name, "path", path)
+
+	stdout, stderr := r.output(name).streams()
+
+	m := &actionModule{
+		env: interp.New(interp.Options{
+			GoPath: r.actionsPath,
+			Stdout: stdout,
+			Stderr: stderr,
+		}),
+		signals: newSignalTable(),
+		path:    path,
+		pkg:     name,
+	}
+
+	symbols, err := SandboxSymbols(name, r.actionsPath, path, r.opts.Capabilities[name])
+	if err != nil {
+		slog.Error("refusing to load action", "name", name, "error", err.Error())
+		return nil, err
+	}
+
+	if err := m.env.Use(symbols); err != nil {
+		slog.Error("yaegi failed to import stdlib symbols")
+		return nil, err
+	}
+
+	if err := m.env.Use(r.exports(name)); err != nil {
+		slog.Error("yaegi failed to import EMRS functionality")
+		return nil, err
+	}
+
+	if err := r.evalModule(m); err != nil {
+		slog.Error("yaegi failed to eval module", "path", path, "error", err.Error())
+		return nil, err
+	}
 
-		m := actionModule{
-			env: interp.New(interp.Options{GoPath: actionsPath}),
+	// The module is staged while OnInit runs so that any
+	// subscriptions it makes can be attached to it
+	r.mu.Lock()
+	r.loading[name] = m
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.loading, name)
+		r.mu.Unlock()
+	}()
+
+	vOnInitFn, ok := m.symbol("OnInit")
+	if ok {
+		onInitFn, isFn := vOnInitFn.Interface().(func() error)
+		if !isFn {
+			slog.Error("module `OnInit` must be of type `func() error`", "name", name)
+			return nil, fmt.Errorf("OnInit in action %s is not a func() error", name)
+		}
+		if err := onInitFn(); err != nil {
+			slog.Error("error experienced within rootFile onInit function", "error", err.Error())
+			return nil, err
 		}
+	} else {
+		slog.Info("module does not contain an `OnInit` function", "name", name)
+	}
+
+	return m, nil
+}
+
+// Retrieve the output buffer of an action, creating it if need be.
+// Buffers are kept across reloads of the action
+func (r *yaegiRunner) output(action string) *actionOutput {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	output, ok := r.outputs[action]
+	if !ok {
+		output = newActionOutput(action, r.opts.OutputLines, r.opts.OutputDir)
+		r.outputs[action] = output
+	}
+	return output
+}
+
+// Record a line of output on behalf of an action (emrs.Log)
+func (r *yaegiRunner) Log(action string, text string) {
+	r.output(action).add(OutputLog, text)
+}
+
+// Retrieve the lines of an action's output newer than `after`
+func (r *yaegiRunner) Output(action string, after int64) ([]OutputLine, error) {
+	r.mu.RLock()
+	output, ok := r.outputs[action]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownAction
+	}
+	return output.since(after), nil
+}
+
+// Single files are evaluated directly. Package directories have to be
+// imported from the actions GOPATH so that the interpreter can resolve
+// the packages they import from it (their own subpackages, shared
+// libraries, ...)
+func (r *yaegiRunner) evalModule(m *actionModule) error {
+
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		_, err := m.env.EvalPath(m.path)
+		return err
+	}
+
+	src := filepath.Join(r.actionsPath, "src")
+	rel, err := filepath.Rel(src, m.path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%w: %s is not within %s", ErrPackageOutsideActions, m.path, src)
+	}
+
+	m.pkg = filepath.ToSlash(rel)
+	_, err = m.env.Eval(fmt.Sprintf("import %q", m.pkg))
+	return err
+}
+
+// Retrieve an exported symbol from the action's package
+func (m *actionModule) symbol(name string) (reflect.Value, bool) {
+	pkg, ok := m.env.Symbols(m.pkg)[m.pkg]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	value, ok := pkg[name]
+	return value, ok
+}
 
-		if err := m.env.Use(stdlib.Symbols); err != nil {
-			slog.Error("yaegi failed to import stdlib symbols")
+// The latest modification of the action's source. Package
+// directories are walked, as editing a file within a directory
+// does not change the directory itself
+func actionModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !info.IsDir() {
+		return info.ModTime(), nil
+	}
+
+	latest := info.ModTime()
+	err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
+		if entry.IsDir() || !strings.HasSuffix(file, ".go") {
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if fileInfo.ModTime().After(latest) {
+			latest = fileInfo.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// Subscribe a function within an action to a signal. This is meant to be
+// called by the action itself (emrs.Subscribe) during or after its OnInit
+func (r *yaegiRunner) Subscribe(action string, signal string, function string) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.loading[action]
+	if !ok {
+		m, ok = r.actions[action]
+	}
+	if !ok {
+		slog.Error("subscription requested for unknown action", "action", action, "signal", signal)
+		return ErrUnknownAction
+	}
+
+	slog.Debug("action subscribed to signal", "action", action, "signal", signal, "fn", function)
+	return m.signals.add(signal, fmt.Sprintf("%s.%s", action, function))
+}
+
+// Submit a job for every subscriber of the given signal. The signal's
+// chunks are appended to each subscriber's destination to form the route
+func (r *yaegiRunner) Emit(origin string, signal string, data []byte) error {
+
+	route, err := api.DecomposeRoute(signal)
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	destinations := append([][]string{}, r.signals.lookup(signal)...)
+	for _, m := range r.actions {
+		destinations = append(destinations, m.signals.lookup(signal)...)
+	}
+	r.mu.RUnlock()
 
-		if err := m.env.Use(exports); err != nil {
-			slog.Error("yaegi failed to import EMRS functionality")
+	slog.Debug("emit signal", "origin", origin, "signal", signal, "subscribers", len(destinations))
+
+	for _, dest := range destinations {
+
+		destination := make([]string, 0, len(dest)+len(route))
+		destination = append(destination, dest...)
+		destination = append(destination, route...)
+
+		if err := r.SubmitJob(&Job{
+			Origin:      origin,
+			Destination: destination,
+			Data:        data,
+		}); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// Queue a job for execution. If the job has no id one is assigned.
+// The job is journaled before it is queued, so once this returns
+// without error the job will run even if the server goes down.
+// If the queue is full the job is refused with ErrQueueFull rather
+// than waiting for room
+func (r *yaegiRunner) SubmitJob(job *Job) error {
+	slog.Debug("submit job to runner")
+
+	r.books.RLock()
+	defer r.books.RUnlock()
 
-		_, err := m.env.EvalPath(path)
+	if r.stopping() || r.detached {
+		return ErrRunnerStopped
+	}
+
+	if job.Received.IsZero() {
+		job.Received = time.Now()
+	}
+
+	if job.Id == "" {
+		id, err := badger.GenerateId()
 		if err != nil {
-			slog.Error("yaegi failed to eval module file", "file", path, "error", err.Error())
+			slog.Error("failed to generate job id", "error", err.Error())
 			return err
 		}
+		job.Id = id
+	}
 
-		vOnInitFn, getErr := m.env.Eval(fmt.Sprintf("%s.OnInit", name))
-		if getErr == nil {
-			onInitFn := vOnInitFn.Interface().(func() error)
-			if err := onInitFn(); err != nil {
-				slog.Error("error experienced within rootFile onInit function", "error", err.Error())
-				return err
-			}
-		} else {
-			slog.Info("module does not contain an `OnInit` function", "name", name)
+	if err := r.journal(job); err != nil {
+		return err
+	}
+
+	r.status.set(job, JobQueued, nil)
+	r.gates.place(job)
+
+	select {
+	case r.queue <- job:
+		return nil
+	default:
+		slog.Error("job queue is full; refusing job", "from", job.Origin, "to", job.Destination, "queue", r.opts.QueueSize)
+		for _, next := range r.gates.withdraw(job) {
+			go r.enqueue(next)
 		}
+		r.status.remove(job.Id)
+		r.unjournal(job)
+		return ErrQueueFull
+	}
+}
+
+// Queue every job left in the journal by a previous run of the server.
+// The jobs are handed to the workers in the order they were accepted,
+// waiting for room in the queue as needed
+func (r *yaegiRunner) Replay() error {
 
-		// ---
+	if r.db == nil {
+		return nil
+	}
 
-		r.actions[name] = m
+	jobs := r.db.GetJobs()
+	if len(jobs) == 0 {
+		return nil
 	}
 
+	slog.Info("replaying unfinished jobs", "count", len(jobs))
+
+	pending := make([]*Job, 0, len(jobs))
+	for _, entry := range jobs {
+		route, err := api.DecomposeRoute(entry.Route)
+		if err != nil {
+			slog.Error("dropping journaled job with invalid route", "id", entry.Id, "route", entry.Route)
+			r.db.RemoveJob(entry.Id)
+			continue
+		}
+		job := &Job{
+			Id:          entry.Id,
+			Origin:      entry.Origin,
+			Destination: route,
+			Data:        entry.Data,
+			Attempts:    entry.Attempts,
+			Received:    entry.Received,
+			Headers:     entry.Headers,
+			Version:     entry.Version,
+			Tags:        entry.Tags,
+			Event:       entry.Event,
+		}
+
+		// Journaled before submissions were timestamped
+		if entry.Received.Unix() <= 0 {
+			job.Received = entry.Created
+		}
+		r.status.set(job, JobQueued, nil)
+		r.gates.place(job)
+		pending = append(pending, job)
+	}
+
+	go func() {
+		for _, job := range pending {
+			r.enqueue(job)
+		}
+	}()
 	return nil
 }
 
-func (r *yaegiRunner) SubmitJob(job *Job) error {
-	slog.Debug("submit job to runner")
+// Move a dead letter back into the queue. The job keeps its
+// id but is given a fresh set of attempts
+func (r *yaegiRunner) RetryDeadLetter(id string) error {
+
+	if r.db == nil {
+		return ErrUnknownJob
+	}
+
+	letter, err := r.db.GetDeadLetter(id)
+	if err != nil {
+		slog.Error("unable to retrieve dead letter", "id", id, "error", err.Error())
+		return ErrUnknownJob
+	}
+
+	route, err := api.DecomposeRoute(letter.Route)
+	if err != nil {
+		return err
+	}
 
-	// TODO: We should add the context here that terminated the thread if it exceeds the
-	//        maximum time from the server.cfg file
+	// The letter is removed first as the job may fail
+	// and be dead lettered again before submission returns
+	if err := r.db.RemoveDeadLetter(id); err != nil {
+		return err
+	}
+
+	job := &Job{
+		Id:          letter.Id,
+		Origin:      letter.Origin,
+		Destination: route,
+		Data:        letter.Data,
+		Headers:     letter.Headers,
+		Version:     letter.Version,
+		Tags:        letter.Tags,
+		Event:       letter.Event,
+	}
+	if letter.Received.Unix() > 0 {
+		job.Received = letter.Received
+	}
+
+	// The event is reopened first as the job may complete
+	// before submission returns
+	if job.Event != "" {
+		r.db.ReopenEventJob(job.Event)
+	}
 
-	go r.processJob(job)
+	if err := r.SubmitJob(job); err != nil {
+		r.db.AddDeadLetter(letter)
+		if job.Event != "" {
+			r.db.CompleteEventJob(job.Event, letter.Error)
+		}
+		return err
+	}
+	return nil
+}
 
+func (r *yaegiRunner) journal(job *Job) error {
+	if r.db == nil {
+		return nil
+	}
+	if err := r.db.AddJob(datastore.Job{
+		Id:      job.Id,
+		Origin:  job.Origin,
+		Route:   strings.Join(job.Destination, "."),
+		Data:    job.Data,
+		Created: time.Now(),
+		Submission: datastore.Submission{
+			Received: job.Received,
+			Headers:  job.Headers,
+			Version:  job.Version,
+			Tags:     job.Tags,
+			Event:    job.Event,
+		},
+	}); err != nil {
+		slog.Error("failed to journal job", "id", job.Id, "error", err.Error())
+		return err
+	}
 	return nil
 }
 
-func (r *yaegiRunner) processJob(job *Job) {
-	slog.Info("processing job", "from", job.Origin, "to", job.Destination)
+func (r *yaegiRunner) unjournal(job *Job) {
+	if r.db == nil {
+		return
+	}
+	r.db.RemoveJob(job.Id)
+}
+
+func (r *yaegiRunner) JobStatus(id string) (JobStatus, error) {
+	status, ok := r.status.get(id)
+	if !ok {
+		return status, ErrUnknownJob
+	}
+	return status, nil
+}
 
-	if len(job.Destination) < 2 {
-		slog.Error("invalid destination; expected at least 'action.function'", "route-len", len(job.Destination))
+func (r *yaegiRunner) worker() {
+	defer r.workers.Done()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case job := <-r.queue:
+			r.execute(job)
+		}
+	}
+}
+
+// Run the job if its action's concurrency limit allows, then any jobs
+// that were held waiting on it. A job that is to be retried keeps its
+// place under the limit until the retry is run
+func (r *yaegiRunner) execute(job *Job) {
+
+	ready := r.gates.acquire(job)
+	if len(ready) == 0 {
+		slog.Debug("job held by concurrency limit", "id", job.Id, "to", job.Destination)
 		return
 	}
 
-	actionName := job.Destination[0]
+	for len(ready) > 0 {
+
+		// Jobs let through alongside this one are left to other workers
+		for _, next := range ready[1:] {
+			go r.enqueue(next)
+		}
+
+		if !r.runJob(ready[0]) {
+			return
+		}
+		ready = r.gates.release(ready[0])
+	}
+}
+
+// Wait for room in the queue. If the runner stops first the job is left
+// where it is, in the journal, to be picked up by the next start
+func (r *yaegiRunner) enqueue(job *Job) {
+	select {
+	case <-r.stop:
+	case r.queue <- job:
+	}
+}
+
+func (r *yaegiRunner) stopping() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop taking jobs, let the jobs that are executing finish, and give every
+// action the chance to clean up through its optional OnShutdown function.
+// Jobs waiting in the queue, or on a retry, are not run, they remain
+// journaled. If the context expires before the executing jobs finish they
+// are abandoned: their outcome is not recorded, and their actions are not
+// given OnShutdown while their calls are still running
+func (r *yaegiRunner) Shutdown(ctx context.Context) error {
+
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+
+	slog.Info("runner shutting down; waiting for executing jobs")
+
+	finished := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		r.abandoned.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		slog.Warn("runner shutdown timed out; abandoning executing jobs")
+	}
+
+	// Jobs finishing from here on are left in the journal, as the
+	// datastore is closed once the runner has shut down
+	r.books.Lock()
+	r.detached = true
+	r.books.Unlock()
+
+	r.timersMu.Lock()
+	for id, timer := range r.timers {
+		timer.Stop()
+		delete(r.timers, id)
+	}
+	r.timersMu.Unlock()
+
+	r.mu.RLock()
+	actions := r.actions
+	r.mu.RUnlock()
+
+	var errs []error
+	for name, m := range actions {
+
+		vOnShutdownFn, ok := m.symbol("OnShutdown")
+		if !ok {
+			continue
+		}
+
+		// Cleaning up beneath a handler that is still running could
+		// leave it to fail part way through, so the action is left be
+		if calls := m.calls.Load(); calls > 0 {
+			slog.Warn("not calling OnShutdown, the action still has calls running", "name", name, "calls", calls)
+			continue
+		}
+
+		onShutdownFn, isFn := vOnShutdownFn.Interface().(func() error)
+		if !isFn {
+			slog.Error("module `OnShutdown` must be of type `func() error`", "name", name)
+			continue
+		}
+
+		if err := onShutdownFn(); err != nil {
+			slog.Error("error experienced within action OnShutdown function", "name", name, "error", err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	r.mu.Lock()
+	for _, output := range r.outputs {
+		output.close()
+	}
+	r.mu.Unlock()
+
+	return errors.Join(errs...)
+}
+
+// Execute a job, giving it at most the configured time limit. The interpreter
+// offers no way to cancel a function mid-flight, so a job that exceeds the
+// limit is abandoned: it is reported and the worker moves on to the next job.
+// Returns false if the job is not finished, as it has been scheduled to retry
+// or is held under its action's concurrency limit by an abandoned call
+func (r *yaegiRunner) runJob(job *Job) bool {
+
+	r.status.set(job, JobRunning, nil)
+
+	done := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("job panicked", "id", job.Id, "from", job.Origin, "to", job.Destination, "panic", e)
+				done <- fmt.Errorf("job panicked: %v", e)
+			}
+		}()
+		done <- r.processJob(job)
+	}()
+
+	timer := time.NewTimer(r.opts.JobTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-timer.C:
+		slog.Error("job exceeded time limit and was abandoned", "id", job.Id, "from", job.Origin, "to", job.Destination, "limit", r.opts.JobTimeout)
+		err = ErrJobTimeout
 
+		// The abandoned call is still running in the action, so a job under
+		// a concurrency limit keeps its place until the call returns rather
+		// than letting a retry, or the next job, run alongside it
+		if job.gated {
+			r.abandoned.Add(1)
+			go r.awaitAbandoned(job, done)
+			return false
+		}
+	}
+
+	return r.finishJob(job, err)
+}
+
+// Wait out the abandoned call of a job under a concurrency limit, then
+// finish the job as having timed out. If it is not retried, its place
+// goes to the next job waiting on it
+func (r *yaegiRunner) awaitAbandoned(job *Job, done chan error) {
+
+	defer r.abandoned.Done()
+
+	<-done
+
+	slog.Warn("abandoned job returned", "id", job.Id, "to", job.Destination)
+
+	if !r.finishJob(job, ErrJobTimeout) {
+		return
+	}
+
+	for _, next := range r.gates.release(job) {
+		r.enqueue(next)
+	}
+}
+
+// Record the result of a job's attempt. Returns false if the
+// job is not finished, as it has been scheduled to retry
+func (r *yaegiRunner) finishJob(job *Job, err error) bool {
+
+	r.books.RLock()
+	defer r.books.RUnlock()
+
+	if r.detached {
+		slog.Warn("job finished after shutdown; leaving it journaled", "id", job.Id, "to", job.Destination)
+		return true
+	}
+
+	if err == nil {
+		r.unjournal(job)
+		r.completeEvent(job, nil)
+		r.status.set(job, JobSucceeded, nil)
+		return true
+	}
+
+	job.Attempts++
+
+	policy := r.retryPolicy(job, err)
+	if job.Attempts < policy.Attempts {
+		r.retry(job, policy.delay(job.Attempts), err)
+		return false
+	}
+
+	slog.Error("job failed all attempts", "id", job.Id, "attempts", job.Attempts, "error", err.Error())
+
+	r.deadLetter(job, err)
+	r.unjournal(job)
+	r.completeEvent(job, err)
+	r.status.set(job, JobFailed, err)
+	return true
+}
+
+// Jobs failing in a pipeline stage are retried under the policy of the
+// stage, unless the pipeline has a policy of its own
+func (r *yaegiRunner) retryPolicy(job *Job, err error) RetryPolicy {
+	var stage *stageError
+	if !errors.As(err, &stage) {
+		return r.retries.lookup(job.Destination)
+	}
+	if policy, ok := r.retries.find(job.Destination); ok {
+		return policy
+	}
+	return r.retries.lookup(stage.destination)
+}
+
+// Report the final result of a job to the event it was created for
+func (r *yaegiRunner) completeEvent(job *Job, cause error) {
+	if r.db == nil || job.Event == "" {
+		return
+	}
+	message := ""
+	if cause != nil {
+		message = cause.Error()
+	}
+	if err := r.db.CompleteEventJob(job.Event, message); err != nil {
+		slog.Error("failed to record event outcome", "id", job.Event, "job", job.Id, "error", err.Error())
+	}
+}
+
+// Place a failed job back in the queue once the delay has passed.
+// The job stays journaled as it is not yet finished
+func (r *yaegiRunner) retry(job *Job, delay time.Duration, cause error) {
+
+	slog.Warn("job failed; scheduling retry", "id", job.Id, "attempts", job.Attempts, "delay", delay, "error", cause.Error())
+
+	if r.db != nil {
+		r.db.UpdateJobAttempts(job.Id, job.Attempts)
+	}
+
+	r.status.set(job, JobQueued, cause)
+
+	r.timersMu.Lock()
+	defer r.timersMu.Unlock()
+
+	r.timers[job.Id] = time.AfterFunc(delay, func() {
+		r.timersMu.Lock()
+		delete(r.timers, job.Id)
+		r.timersMu.Unlock()
+		r.enqueue(job)
+	})
+}
+
+func (r *yaegiRunner) deadLetter(job *Job, cause error) {
+	if r.db == nil {
+		return
+	}
+	if err := r.db.AddDeadLetter(datastore.DeadLetter{
+		Id:       job.Id,
+		Origin:   job.Origin,
+		Route:    strings.Join(job.Destination, "."),
+		Data:     job.Data,
+		Attempts: job.Attempts,
+		Error:    cause.Error(),
+		Failed:   time.Now(),
+		Submission: datastore.Submission{
+			Received: job.Received,
+			Headers:  job.Headers,
+			Version:  job.Version,
+			Tags:     job.Tags,
+			Event:    job.Event,
+		},
+	}); err != nil {
+		slog.Error("failed to store dead letter", "id", job.Id, "error", err.Error())
+	}
+}
+
+func (r *yaegiRunner) processJob(job *Job) error {
+	slog.Info("processing job", "id", job.Id, "from", job.Origin, "to", job.Destination)
+
+	if len(job.Destination) < 1 {
+		slog.Error("invalid destination; expected at least 'action.function'", "route-len", len(job.Destination))
+		return api.ErrMalformedRoute
+	}
+
+	if stages, ok := r.pipelines[job.Destination[0]]; ok {
+
+		// Actions installed since the server started
+		// may have taken the pipeline's name
+		r.mu.RLock()
+		_, collides := r.actions[job.Destination[0]]
+		r.mu.RUnlock()
+		if collides {
+			slog.Error("pipeline shares its name with an action", "name", job.Destination[0])
+			return fmt.Errorf("%w: %s is also the name of an action", ErrInvalidPipeline, job.Destination[0])
+		}
+
+		if err := r.runPipeline(job, job.Destination[0], stages); err != nil {
+			return err
+		}
+	} else if _, err := r.callHandler(job, job.Destination, job.Data); err != nil && !errors.Is(err, ErrHalt) {
+		return err
+	}
+
+	slog.Debug("processing complete")
+	return nil
+}
+
+// Call the handler at the destination on behalf of the job with the given
+// data. Handlers that produce output (pipeline stages) have it returned,
+// otherwise the data they were given is returned as their output
+func (r *yaegiRunner) callHandler(job *Job, destination []string, data []byte) ([]byte, error) {
+
+	if len(destination) < 2 {
+		slog.Error("invalid destination; expected at least 'action.function'", "route-len", len(destination))
+		return nil, api.ErrMalformedRoute
+	}
+
+	actionName := destination[0]
+
+	r.mu.RLock()
 	target, ok := r.actions[actionName]
+	r.mu.RUnlock()
 	if !ok {
 		slog.Error("unknown action for chunk in request", "name", actionName)
-		return
+		return nil, ErrUnknownAction
 	}
 
-	symbols := target.env.Symbols(actionName)
-
-	packageMap, pmOk := symbols[actionName]
+	packageMap, pmOk := target.env.Symbols(target.pkg)[target.pkg]
 	if !pmOk {
-		slog.Error("failed to retrieve expected package from module", "expected-package", actionName)
-		return
+		slog.Error("failed to retrieve expected package from module", "expected-package", target.pkg)
+		return nil, fmt.Errorf("action %s does not provide package %s", actionName, target.pkg)
 	}
 
-	targetFnName := job.Destination[1]
+	targetFnName := destination[1]
 
 	vTargetFn, ok := packageMap[targetFnName]
 
 	if !ok {
 		slog.Error("failed to locate function in action module", "module", actionName, "fn", targetFnName)
-		return
+		return nil, fmt.Errorf("unknown function %s in action %s", targetFnName, actionName)
 	}
 
-	targetFn := vTargetFn.Interface().(func(string, []string, []byte) error)
-	if err := targetFn(job.Origin, job.Destination[2:], job.Data); err != nil {
-		slog.Error("error experienced while processing function call", "module", actionName, "fn", targetFnName, "error", err.Error())
-		return
+	// Events are built for the handler being called, which
+	// within a pipeline is not the job's own destination
+	event := func() Event {
+		stage := *job
+		stage.Destination = destination
+		stage.Data = data
+		return r.buildEvent(&stage)
 	}
 
-	slog.Debug("processing complete")
+	// Handlers take either the event, or its origin, route and data
+	var err error
+	target.calls.Add(1)
+	defer target.calls.Add(-1)
+
+	output := data
+	switch targetFn := vTargetFn.Interface().(type) {
+	case func(string, []string, []byte) error:
+		err = targetFn(job.Origin, destination[2:], data)
+	case func(Event) error:
+		err = targetFn(event())
+	case func(string, []string, []byte) ([]byte, error):
+		output, err = targetFn(job.Origin, destination[2:], data)
+	case func(Event) ([]byte, error):
+		output, err = targetFn(event())
+	default:
+		slog.Error("function in action module is not a handler", "module", actionName, "fn", targetFnName)
+		return nil, fmt.Errorf("function %s in action %s is not a handler", targetFnName, actionName)
+	}
+
+	if err != nil && !errors.Is(err, ErrHalt) {
+		slog.Error("error experienced while processing function call", "module", actionName, "fn", targetFnName, "error", err.Error())
+	}
+	return output, err
 }
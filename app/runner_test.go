@@ -0,0 +1,454 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/traefik/yaegi/interp"
+)
+
+// What actions under test report through the `record` package. Actions
+// may also block on record.Hold until the test lets them go
+type recorder struct {
+	mu      sync.Mutex
+	entries []string
+	added   chan struct{}
+	release chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		added:   make(chan struct{}, 4096),
+		release: make(chan struct{}),
+	}
+}
+
+func (rec *recorder) add(entry string) {
+	rec.mu.Lock()
+	rec.entries = append(rec.entries, entry)
+	rec.mu.Unlock()
+	rec.added <- struct{}{}
+}
+
+func (rec *recorder) hold() {
+	<-rec.release
+}
+
+// Wait for n more entries to be recorded
+func (rec *recorder) wait(t *testing.T, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-rec.added:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for actions to report")
+		}
+	}
+}
+
+func (rec *recorder) list() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string{}, rec.entries...)
+}
+
+// Write files (by path within the actions directory) to a new
+// actions directory, returning where it is
+func writeActionFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Load the actions of the map into a new runner, offering them the `emrs`
+// package of an App without a datastore and a `record` package
+func startTestRunner(t *testing.T, opts RunnerOpts, dir string, actionMap map[string]string) (*yaegiRunner, *recorder) {
+	t.Helper()
+
+	rec := newRecorder()
+	runner := newYaegiRunner(opts, nil)
+	a := &App{runner: runner}
+
+	exports := func(action string) interp.Exports {
+		symbols := a.buildYaegiExports(action)
+		symbols["record/record"] = map[string]reflect.Value{
+			"Add":  reflect.ValueOf(rec.add),
+			"Hold": reflect.ValueOf(rec.hold),
+		}
+		return symbols
+	}
+
+	if err := runner.Load(dir, actionMap, exports); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		runner.Shutdown(ctx)
+	})
+	return runner, rec
+}
+
+// Start a runner over single file actions, given by name
+func loadTestRunner(t *testing.T, opts RunnerOpts, sources map[string]string) (*yaegiRunner, *recorder) {
+	t.Helper()
+
+	files := make(map[string]string)
+	actionMap := make(map[string]string)
+	for name, source := range sources {
+		files[name+".go"] = source
+	}
+
+	dir := writeActionFiles(t, files)
+	for name := range sources {
+		actionMap[name] = filepath.Join(dir, name+".go")
+	}
+	return startTestRunner(t, opts, dir, actionMap)
+}
+
+func waitForState(t *testing.T, runner *yaegiRunner, id string, state JobState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if status, err := runner.JobStatus(id); err == nil && status.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for job %s to be %s", id, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func submitTestJob(t *testing.T, runner *yaegiRunner, job *Job) {
+	t.Helper()
+	if err := runner.SubmitJob(job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerConcurrencyOrder(t *testing.T) {
+
+	runner, rec := loadTestRunner(t, RunnerOpts{
+		Workers:   8,
+		QueueSize: 1024,
+		Concurrency: map[string]Concurrency{
+			"ordered": {Limit: 1, PerOrigin: true},
+		},
+	}, map[string]string{
+		"ordered": `package ordered
+
+import "record"
+
+func Got(origin string, route []string, data []byte) error {
+	record.Add(origin + ":" + string(data))
+	return nil
+}
+`,
+	})
+
+	const count = 500
+	origins := []string{"a", "b"}
+
+	for i := range count {
+		for _, origin := range origins {
+			submitTestJob(t, runner, &Job{
+				Origin:      origin,
+				Destination: []string{"ordered", "Got"},
+				Data:        []byte(strconv.Itoa(i)),
+			})
+		}
+	}
+
+	rec.wait(t, count*len(origins))
+
+	next := map[string]int{}
+	for _, entry := range rec.list() {
+		origin, seq := entry[:1], entry[2:]
+		if seq != strconv.Itoa(next[origin]) {
+			t.Fatalf("origin %s: expected job %d, got %s", origin, next[origin], seq)
+		}
+		next[origin]++
+	}
+}
+
+func TestRunnerShutdownWithRunningCalls(t *testing.T) {
+
+	runner, rec := loadTestRunner(t, RunnerOpts{Workers: 2}, map[string]string{
+		"slow": `package slow
+
+import (
+	"record"
+	"time"
+)
+
+func Wait(origin string, route []string, data []byte) error {
+	record.Add("started")
+	time.Sleep(500 * time.Millisecond)
+	return nil
+}
+
+func OnShutdown() error {
+	record.Add("shutdown")
+	return nil
+}
+`,
+		"idle": `package idle
+
+import "record"
+
+func Noop(origin string, route []string, data []byte) error {
+	return nil
+}
+
+func OnShutdown() error {
+	record.Add("idle shutdown")
+	return nil
+}
+`,
+	})
+
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"slow", "Wait"}})
+	rec.wait(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	runner.Shutdown(ctx)
+
+	entries := rec.list()
+	if slices.Contains(entries, "shutdown") {
+		t.Fatal("expected OnShutdown to be skipped while a call is running")
+	}
+	if !slices.Contains(entries, "idle shutdown") {
+		t.Fatalf("expected OnShutdown for an idle action, got %v", entries)
+	}
+
+	if err := runner.SubmitJob(&Job{Origin: "a", Destination: []string{"idle", "Noop"}}); err != ErrRunnerStopped {
+		t.Fatalf("expected jobs to be refused after shutdown, got %v", err)
+	}
+}
+
+func TestRunnerHandlers(t *testing.T) {
+
+	runner, rec := loadTestRunner(t, RunnerOpts{Workers: 2}, map[string]string{
+		"sig": `package sig
+
+import (
+	"emrs"
+	"fmt"
+	"record"
+	"strings"
+)
+
+func Raw(origin string, route []string, data []byte) error {
+	record.Add(fmt.Sprintf("raw %s %s %s", origin, strings.Join(route, "."), data))
+	return nil
+}
+
+func Ev(ev emrs.Event) error {
+	record.Add(fmt.Sprintf("event %s %s %s %s %s %s %s %s %d",
+		ev.Id, ev.Origin, strings.Join(ev.Route, "."), ev.Data, ev.ContentType,
+		ev.Version, strings.Join(ev.Tags, "+"), ev.Headers["X-Test"], ev.Received.Unix()))
+	return nil
+}
+
+func Upper(origin string, route []string, data []byte) ([]byte, error) {
+	return []byte(strings.ToUpper(string(data))), nil
+}
+
+func Wrap(ev emrs.Event) ([]byte, error) {
+	return []byte("<" + string(ev.Data) + ">"), nil
+}
+
+func Stop(ev emrs.Event) ([]byte, error) {
+	return nil, emrs.Halt
+}
+`,
+	})
+
+	runner.pipelines = map[string][][]string{
+		"shout":  {{"sig", "Upper"}, {"sig", "Wrap"}, {"sig", "Raw"}},
+		"halted": {{"sig", "Stop"}, {"sig", "Raw"}},
+	}
+
+	received := time.Unix(1700000000, 0)
+
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"sig", "Raw", "x", "y"}, Data: []byte("hi")})
+	rec.wait(t, 1)
+
+	submitTestJob(t, runner, &Job{
+		Id:          "job-1",
+		Origin:      "a",
+		Destination: []string{"sig", "Ev", "x"},
+		Data:        []byte(`{}`),
+		Received:    received,
+		Headers:     map[string]string{"Content-Type": "application/json; charset=utf-8", "X-Test": "t"},
+		Version:     "1",
+		Tags:        []string{"p", "q"},
+	})
+	rec.wait(t, 1)
+
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"shout", "x"}, Data: []byte("hi")})
+	rec.wait(t, 1)
+
+	submitTestJob(t, runner, &Job{Id: "job-2", Origin: "a", Destination: []string{"halted"}, Data: []byte("hi")})
+	waitForState(t, runner, "job-2", JobSucceeded)
+
+	expected := []string{
+		"raw a x.y hi",
+		"event job-1 a sig.Ev.x {} application/json 1 p+q t 1700000000",
+		"raw a x <HI>",
+	}
+	if entries := rec.list(); !slices.Equal(entries, expected) {
+		t.Fatalf("expected %q, got %q", expected, entries)
+	}
+}
+
+func TestRunnerSignals(t *testing.T) {
+
+	runner, rec := loadTestRunner(t, RunnerOpts{Workers: 2}, map[string]string{
+		"pub": `package pub
+
+import "emrs"
+
+func Fire(origin string, route []string, data []byte) error {
+	emrs.Emit("door.opened", data)
+	return nil
+}
+`,
+		"sub": `package sub
+
+import (
+	"emrs"
+	"record"
+	"strings"
+)
+
+func OnInit() error {
+	return emrs.Subscribe("door.opened", "Heard")
+}
+
+func Heard(origin string, route []string, data []byte) error {
+	record.Add(origin + " " + strings.Join(route, ".") + " " + string(data))
+	return nil
+}
+`,
+	})
+
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"pub", "Fire"}, Data: []byte("front")})
+	rec.wait(t, 1)
+
+	if entries := rec.list(); !slices.Equal(entries, []string{"pub door.opened front"}) {
+		t.Fatalf("unexpected delivery %q", entries)
+	}
+}
+
+func TestRunnerReloadWhileRunning(t *testing.T) {
+
+	dir := writeActionFiles(t, map[string]string{
+		"v1/swap.go": `package swap
+
+import "record"
+
+func Hold(origin string, route []string, data []byte) error {
+	record.Add("v1 holding")
+	record.Hold()
+	record.Add("v1 released")
+	return nil
+}
+
+func Which(origin string, route []string, data []byte) error {
+	record.Add("v1")
+	return nil
+}
+`,
+		"v2/swap.go": `package swap
+
+import "record"
+
+func Which(origin string, route []string, data []byte) error {
+	record.Add("v2")
+	return nil
+}
+`,
+	})
+
+	runner, rec := startTestRunner(t, RunnerOpts{Workers: 2}, dir, map[string]string{
+		"swap": filepath.Join(dir, "v1", "swap.go"),
+	})
+
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"swap", "Hold"}})
+	rec.wait(t, 1)
+
+	loaded, err := runner.Reload(map[string]string{"swap": filepath.Join(dir, "v2", "swap.go")})
+	if err != nil || !slices.Equal(loaded, []string{"swap"}) {
+		t.Fatalf("expected swap to be reloaded, got %v (%v)", loaded, err)
+	}
+
+	// New jobs go to the new interpreter while the old one finishes its call
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"swap", "Which"}})
+	rec.wait(t, 1)
+
+	close(rec.release)
+	rec.wait(t, 1)
+
+	expected := []string{"v1 holding", "v2", "v1 released"}
+	if entries := rec.list(); !slices.Equal(entries, expected) {
+		t.Fatalf("expected %q, got %q", expected, entries)
+	}
+}
+
+func TestRunnerPackageActions(t *testing.T) {
+
+	action := func(name string) string {
+		return `package ` + name + `
+
+import (
+	"lib"
+	"record"
+)
+
+func Hi(origin string, route []string, data []byte) error {
+	record.Add(lib.Greet("` + name + `"))
+	return nil
+}
+`
+	}
+
+	dir := writeActionFiles(t, map[string]string{
+		"src/lib/lib.go":                 "package lib\n\nfunc Greet(name string) string { return \"hello \" + name }\n",
+		"src/example.com/alpha/alpha.go": action("alpha"),
+		"src/example.com/beta/beta.go":   action("beta"),
+	})
+
+	runner, rec := startTestRunner(t, RunnerOpts{Workers: 1}, dir, map[string]string{
+		"alpha": filepath.Join(dir, "src", "example.com", "alpha"),
+		"beta":  filepath.Join(dir, "src", "example.com", "beta"),
+	})
+
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"alpha", "Hi"}})
+	submitTestJob(t, runner, &Job{Origin: "a", Destination: []string{"beta", "Hi"}})
+	rec.wait(t, 2)
+
+	if entries := rec.list(); !slices.Equal(entries, []string{"hello alpha", "hello beta"}) {
+		t.Fatalf("unexpected output %q", entries)
+	}
+}
@@ -0,0 +1,266 @@
+package app
+
+/*
+
+   Actions may be limited to a subset of the standard library by
+   listing their capabilities in the server configuration. Actions
+   without any listed capabilities are given the full set offered
+   by the interpreter, as they always have been.
+
+   Every action may use the packages that do nothing more than
+   compute (strings, encoding/json, ...). Capabilities add to those:
+
+      time         time
+      time-only    same as time, reads better when it is the only one
+      fs           os, io/fs, path/filepath, ...
+      net          net, net/http, net/url, ...
+      exec         os/exec, os/signal
+      all          everything the interpreter offers (aside exec)
+
+   An action that imports a package outside of its capabilities
+   is refused at load time.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/traefik/yaegi/interp"
+	"github.com/traefik/yaegi/stdlib"
+	"github.com/traefik/yaegi/stdlib/unrestricted"
+)
+
+const (
+	CapabilityAll      = "all"
+	CapabilityTime     = "time"
+	CapabilityTimeOnly = "time-only"
+	CapabilityFs       = "fs"
+	CapabilityNet      = "net"
+	CapabilityExec     = "exec"
+)
+
+var ErrUnknownCapability = errors.New("unknown capability")
+var ErrImportNotPermitted = errors.New("import not permitted by action capabilities")
+
+// Packages that every action may import
+var sandboxBasePackages = []string{
+	"bufio", "bytes", "cmp", "container/heap", "container/list", "container/ring",
+	"context", "errors", "fmt", "hash", "hash/adler32", "hash/crc32", "hash/crc64",
+	"hash/fnv", "html", "io", "log", "log/slog", "maps", "math", "math/big",
+	"math/bits", "math/cmplx", "math/rand", "math/rand/v2", "regexp", "slices",
+	"sort", "strconv", "strings", "sync", "sync/atomic", "text/tabwriter",
+	"text/template", "unicode", "unicode/utf16", "unicode/utf8",
+	"compress/flate", "compress/gzip", "compress/zlib",
+	"crypto/hmac", "crypto/md5", "crypto/rand", "crypto/sha1", "crypto/sha256",
+	"crypto/sha512", "crypto/subtle",
+	"encoding", "encoding/base32", "encoding/base64", "encoding/binary",
+	"encoding/csv", "encoding/hex", "encoding/json", "encoding/pem", "encoding/xml",
+}
+
+var capabilityPackages = map[string][]string{
+	CapabilityTime:     {"time"},
+	CapabilityTimeOnly: {"time"},
+	CapabilityFs: {
+		"os", "io/fs", "io/ioutil", "path", "path/filepath",
+		"archive/tar", "archive/zip", "embed", "testing/fstest",
+	},
+	CapabilityNet: {
+		"net", "net/http", "net/http/cookiejar", "net/http/httptrace",
+		"net/http/httputil", "net/mail", "net/netip", "net/smtp",
+		"net/textproto", "net/url", "crypto/tls", "crypto/x509",
+		"mime", "mime/multipart", "mime/quotedprintable",
+	},
+	CapabilityExec: {"os/exec", "os/signal"},
+}
+
+// Make sure every capability listed for every action is known
+func validateCapabilities(capabilities map[string][]string) error {
+	for action, list := range capabilities {
+		for _, capability := range list {
+			if _, ok := capabilityPackages[capability]; !ok && capability != CapabilityAll {
+				slog.Error("unknown capability given to action", "action", action, "capability", capability)
+				return fmt.Errorf("%w: %s (action %s)", ErrUnknownCapability, capability, action)
+			}
+		}
+	}
+	return nil
+}
+
+// Determine the set of packages permitted by the given capabilities.
+// If every package is permitted (no capabilities listed, or 'all'
+// without 'exec') nil is returned
+func sandboxPackages(capabilities []string) map[string]bool {
+
+	if len(capabilities) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, pkg := range sandboxBasePackages {
+		allowed[pkg] = true
+	}
+
+	everything := false
+	for _, capability := range capabilities {
+		if capability == CapabilityAll {
+			everything = true
+			continue
+		}
+		for _, pkg := range capabilityPackages[capability] {
+			allowed[pkg] = true
+		}
+	}
+
+	if everything {
+		for key := range stdlib.Symbols {
+			allowed[symbolsImportPath(key)] = true
+		}
+		if !allowed["os/exec"] {
+			return nil
+		}
+	}
+	return allowed
+}
+
+// Build the standard library symbols offered to an action
+// that may only use the given packages (nil for all of them)
+func sandboxSymbols(allowed map[string]bool) interp.Exports {
+
+	if allowed == nil {
+		return stdlib.Symbols
+	}
+
+	symbols := make(interp.Exports)
+	for key, value := range stdlib.Symbols {
+		if allowed[symbolsImportPath(key)] {
+			symbols[key] = value
+		}
+	}
+
+	// The interpreter keeps process execution out of the standard
+	// library symbols, so it is pulled in only when asked for
+	if allowed["os/exec"] {
+		for key, value := range unrestricted.Symbols {
+			if symbolsImportPath(key) == "os/exec" {
+				symbols[key] = value
+			}
+		}
+	}
+	return symbols
+}
+
+// Check the imports of the named action's source against its capabilities,
+// returning the standard library symbols the action is to be given. The
+// runner loads actions with these, and they are validated with the same
+func SandboxSymbols(name string, actionsPath string, source string, capabilities []string) (interp.Exports, error) {
+
+	if err := validateCapabilities(map[string][]string{name: capabilities}); err != nil {
+		return nil, err
+	}
+
+	allowed := sandboxPackages(capabilities)
+	if allowed != nil {
+		if err := checkSandboxImports(actionsPath, source, allowed); err != nil {
+			return nil, err
+		}
+	}
+	return sandboxSymbols(allowed), nil
+}
+
+// Symbol maps are keyed by "import/path/name"
+func symbolsImportPath(key string) string {
+	if i := strings.LastIndex(key, "/"); i > 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Walk the imports of an action source (file or package directory) and
+// any packages it imports from the actions path, refusing any import
+// that is neither permitted nor provided by emrs or the actions path
+func checkSandboxImports(actionsPath string, source string, allowed map[string]bool) error {
+	return checkImports(actionsPath, source, allowed, make(map[string]bool))
+}
+
+func checkImports(actionsPath string, source string, allowed map[string]bool, visited map[string]bool) error {
+
+	if visited[source] {
+		return nil
+	}
+	visited[source] = true
+
+	files, err := goSourceFiles(source)
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	for _, file := range files {
+
+		parsed, err := parser.ParseFile(fset, file, nil, parser.ImportsOnly)
+		if err != nil {
+			return err
+		}
+
+		for _, spec := range parsed.Imports {
+
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				return err
+			}
+
+			if path == "emrs" || allowed[path] {
+				continue
+			}
+
+			local := filepath.Join(actionsPath, "src", filepath.FromSlash(path))
+			if info, err := os.Stat(local); err == nil && info.IsDir() {
+				if err := checkImports(actionsPath, local, allowed, visited); err != nil {
+					return err
+				}
+				continue
+			}
+
+			slog.Error("action imports a package it is not permitted to", "file", file, "import", path)
+			return fmt.Errorf("%w: %s imports %s", ErrImportNotPermitted, filepath.Base(file), path)
+		}
+	}
+	return nil
+}
+
+// List the go files that make up a source, which may be a single file
+// or a package directory. Test files are not part of an action
+func goSourceFiles(source string) ([]string, error) {
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{source}, nil
+	}
+
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		files = append(files, filepath.Join(source, name))
+	}
+	return files, nil
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSandboxPackages(t *testing.T) {
+
+	if sandboxPackages(nil) != nil {
+		t.Fatal("expected no restrictions without capabilities")
+	}
+
+	if sandboxPackages([]string{CapabilityAll}) != nil {
+		t.Fatal("expected no restrictions with 'all'")
+	}
+
+	allowed := sandboxPackages([]string{CapabilityTimeOnly})
+	if !allowed["time"] || !allowed["strings"] {
+		t.Fatal("expected time and base packages to be allowed")
+	}
+	if allowed["os"] || allowed["net/http"] || allowed["os/exec"] {
+		t.Fatal("expected fs, net, and exec packages to be refused")
+	}
+
+	if err := validateCapabilities(map[string][]string{"x": {"telepathy"}}); !errors.Is(err, ErrUnknownCapability) {
+		t.Fatal("expected unknown capability to be refused")
+	}
+}
+
+func TestSandboxImports(t *testing.T) {
+
+	dir := t.TempDir()
+
+	lib := filepath.Join(dir, "src", "lib")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(path string, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(lib, "lib.go"), "package lib\n\nimport \"os\"\n")
+
+	action := filepath.Join(dir, "action.go")
+	write(action, "package action\n\nimport (\n\t\"emrs\"\n\t\"time\"\n\t\"lib\"\n)\n")
+
+	if err := checkSandboxImports(dir, action, sandboxPackages([]string{CapabilityTime, CapabilityFs})); err != nil {
+		t.Fatalf("expected imports to be permitted: %v", err)
+	}
+
+	err := checkSandboxImports(dir, action, sandboxPackages([]string{CapabilityTime}))
+	if !errors.Is(err, ErrImportNotPermitted) {
+		t.Fatalf("expected import of os through lib to be refused, got: %v", err)
+	}
+
+	if _, err := SandboxSymbols("action", dir, action, []string{CapabilityTime}); !errors.Is(err, ErrImportNotPermitted) {
+		t.Fatalf("expected the action's symbols to be refused, got: %v", err)
+	}
+
+	if _, err := SandboxSymbols("action", dir, action, []string{"telepathy"}); !errors.Is(err, ErrUnknownCapability) {
+		t.Fatalf("expected an unknown capability to be refused, got: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package app
+
+/*
+
+   Schedules let the server invoke actions on its own, without an asset
+   submitting an event. Each schedule is given a route (action.Function
+   with any further chunks handed to the function as its route) and
+   either an interval or a cron expression.
+
+   Jobs created by a schedule have the origin "schedule:<name>". Actions
+   can also request a single invocation some time from now with
+   emrs.After, whose jobs have the requesting action as their origin.
+
+   Neither are durable. Schedules pick up again from the configuration
+   when the server starts, but pending emrs.After calls are lost.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bosley/emrs/api"
+)
+
+const scheduleOriginPrefix = "schedule:"
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+type Schedule struct {
+	Every time.Duration // Run at this interval, or
+	Cron  string        // at the times matching this expression
+	Route string        // action.Function route to invoke
+	Data  []byte        // Handed to the function on each invocation
+}
+
+type scheduleEntry struct {
+	name        string
+	destination []string
+	data        []byte
+	every       time.Duration
+	cron        *cronExpr
+}
+
+// The next time the schedule is due, or the zero time if never
+func (s *scheduleEntry) next(now time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.next(now)
+	}
+	return now.Add(s.every)
+}
+
+func buildSchedules(schedules map[string]Schedule) ([]*scheduleEntry, error) {
+
+	entries := make([]*scheduleEntry, 0, len(schedules))
+	for name, schedule := range schedules {
+
+		destination, err := scheduleDestination(schedule.Route)
+		if err != nil {
+			slog.Error("invalid route given to schedule", "schedule", name, "route", schedule.Route)
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSchedule, name, err.Error())
+		}
+
+		entry := &scheduleEntry{
+			name:        name,
+			destination: destination,
+			data:        schedule.Data,
+			every:       schedule.Every,
+		}
+
+		switch {
+		case schedule.Every > 0 && schedule.Cron != "":
+			return nil, fmt.Errorf("%w: %s: give either an interval or a cron expression, not both", ErrInvalidSchedule, name)
+		case schedule.Cron != "":
+			expr, err := parseCron(schedule.Cron)
+			if err != nil {
+				slog.Error("invalid cron expression given to schedule", "schedule", name, "cron", schedule.Cron)
+				return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSchedule, name, err.Error())
+			}
+			entry.cron = expr
+		case schedule.Every <= 0:
+			return nil, fmt.Errorf("%w: %s: requires an interval or a cron expression", ErrInvalidSchedule, name)
+		}
+
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func scheduleDestination(route string) ([]string, error) {
+	destination, err := api.DecomposeRoute(route)
+	if err != nil {
+		return nil, err
+	}
+	if len(destination) < 2 {
+		return nil, ErrInvalidSubscriber
+	}
+	return destination, nil
+}
+
+func (a *App) startSchedules() {
+	for _, entry := range a.schedules {
+		go a.runSchedule(entry)
+	}
+}
+
+func (a *App) runSchedule(entry *scheduleEntry) {
+
+	slog.Info("schedule started", "schedule", entry.name)
+
+	for {
+		due := entry.next(time.Now())
+		if due.IsZero() {
+			slog.Warn("schedule will never be due again", "schedule", entry.name)
+			return
+		}
+
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-a.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		job := &Job{
+			Origin:      scheduleOriginPrefix + entry.name,
+			Destination: entry.destination,
+			Data:        entry.data,
+		}
+
+		if err := a.runner.SubmitJob(job); err != nil {
+			slog.Error("failed to submit scheduled job", "schedule", entry.name, "error", err.Error())
+			continue
+		}
+		slog.Debug("scheduled job submitted", "schedule", entry.name, "job", job.Id)
+	}
+}
+
+func (a *App) emrsFnAfter(action string, delay time.Duration, route string, data []byte) error {
+
+	destination, err := scheduleDestination(route)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("timer requested", "action", action, "route", route, "delay", delay.String())
+
+	data = append([]byte{}, data...)
+
+	go func() {
+		timer := time.NewTimer(delay)
+		select {
+		case <-a.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		job := &Job{
+			Origin:      action,
+			Destination: destination,
+			Data:        data,
+		}
+
+		if err := a.runner.SubmitJob(job); err != nil {
+			slog.Error("failed to submit timed job", "action", action, "route", route, "error", err.Error())
+		}
+	}()
+	return nil
+}
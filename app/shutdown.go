@@ -0,0 +1,89 @@
+package app
+
+/*
+
+   Shutdown happens in this order:
+
+      1. The runner stops taking jobs, so submissions are refused
+         and scheduled jobs, timers and the action watcher stop
+      2. Jobs that are executing are given time to finish. Jobs
+         still queued, or waiting on a retry, are left in the journal
+         for the next start. Jobs that don't finish in time are left
+         there as well, whenever their calls return
+      3. Each action's optional `OnShutdown() error` is called,
+         unless the action has calls that are still running
+      4. The http server stops, letting open requests complete
+      5. The datastore is closed
+
+   A CNC shutdown request, SIGINT and SIGTERM all lead here.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long the whole shutdown sequence may take before
+// executing jobs and open requests are abandoned
+const DefaultShutdownTimeout = time.Minute
+
+func (a *App) Shutdown(ctx context.Context) error {
+
+	var err error
+	a.shutdownOnce.Do(func() {
+		defer close(a.done)
+
+		slog.Info("shutdown started")
+
+		a.cancel()
+
+		var errs []error
+		if e := a.runner.Shutdown(ctx); e != nil {
+			errs = append(errs, e)
+		}
+
+		if a.server != nil {
+			if e := a.server.Shutdown(ctx); e != nil {
+				slog.Error("http server did not shut down cleanly", "error", e.Error())
+				errs = append(errs, e)
+			}
+		}
+
+		a.db.Close()
+
+		err = errors.Join(errs...)
+		slog.Info("shutdown complete")
+	})
+	return err
+}
+
+// Run the shutdown sequence, in the background, with the default time limit
+func (a *App) shutdownInBackground() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+		defer cancel()
+		a.Shutdown(ctx)
+	}()
+}
+
+// Shut down on the first SIGINT or SIGTERM. Once shutdown has begun the
+// signals are released, so a second one stops the process immediately
+func (a *App) handleSignals() {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-a.done:
+	case sig := <-signals:
+		slog.Info("signal received", "signal", sig.String())
+		a.shutdownInBackground()
+	}
+	signal.Stop(signals)
+}
@@ -0,0 +1,66 @@
+package app
+
+/*
+
+   Signals are '.' composed names (door.open) that actions can
+   emit to trigger other actions without an asset being involved.
+
+   Every subscriber to a signal is an action route (action.Function)
+   that will receive a job whenever the signal is emitted. The chunks
+   of the signal itself are handed to the subscriber as its route.
+
+   Subscriptions come from the `signals` section of server.cfg,
+   or from an action calling `emrs.Subscribe` (typically in OnInit)
+
+*/
+
+import (
+	"errors"
+	"github.com/bosley/emrs/api"
+	"log/slog"
+	"slices"
+)
+
+var ErrInvalidSubscriber = errors.New("subscriber must be of the form 'action.Function'")
+
+// Maps a signal name to each of the destinations subscribed to it
+type signalTable map[string][][]string
+
+func newSignalTable() signalTable {
+	return make(signalTable)
+}
+
+// Add a subscriber to the signal. Both the signal and
+// the destination must be valid emrs routes, and the
+// destination must at least name an action and a function
+func (t signalTable) add(signal string, destination string) error {
+
+	if _, err := api.DecomposeRoute(signal); err != nil {
+		slog.Error("invalid signal name", "signal", signal)
+		return err
+	}
+
+	dest, err := api.DecomposeRoute(destination)
+	if err != nil {
+		slog.Error("invalid signal subscriber", "signal", signal, "subscriber", destination)
+		return err
+	}
+
+	if len(dest) < 2 {
+		slog.Error("signal subscriber does not name a function", "signal", signal, "subscriber", destination)
+		return ErrInvalidSubscriber
+	}
+
+	for _, existing := range t[signal] {
+		if slices.Equal(existing, dest) {
+			return nil
+		}
+	}
+
+	t[signal] = append(t[signal], dest)
+	return nil
+}
+
+func (t signalTable) lookup(signal string) [][]string {
+	return t[signal]
+}
@@ -4,6 +4,8 @@ package app
 
    /     JSON dump of server status
              - uptime,
+             - throttled, submissions refused for
+               exceeding a rate limit
 
 
              Later we will add more than uptime, but
@@ -25,6 +27,7 @@ func (a *App) setupStat(gins *gin.Engine) {
 
 func (a *App) statRoot(c *gin.Context) {
 	c.JSON(200, gin.H{
-		"uptime": time.Since(a.started).Truncate(time.Second),
+		"uptime":    time.Since(a.started).Truncate(time.Second),
+		"throttled": a.limiter.throttled.Load(),
 	})
 }
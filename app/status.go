@@ -0,0 +1,105 @@
+package app
+
+import (
+	"errors"
+	"github.com/bosley/emrs/api"
+	"slices"
+	"sync"
+)
+
+const (
+	// Number of finished jobs whose status is kept around
+	// for lookup before the oldest are forgotten
+	maxRetainedJobStatus = 4096
+)
+
+var ErrUnknownJob = errors.New("unknown job")
+
+type JobState string
+
+const (
+	JobQueued    JobState = api.JobQueued
+	JobRunning   JobState = api.JobRunning
+	JobSucceeded JobState = api.JobSucceeded
+	JobFailed    JobState = api.JobFailed
+)
+
+type JobStatus struct {
+	Id     string
+	Origin string
+	State  JobState
+	Error  string
+}
+
+func (s JobState) finished() bool {
+	return s == JobSucceeded || s == JobFailed
+}
+
+// Tracks the state of every job the runner knows about. Jobs that
+// have finished are retained up to a limit, oldest forgotten first
+type jobStatusTable struct {
+	mu       sync.Mutex
+	entries  map[string]*JobStatus
+	finished []string
+}
+
+func newJobStatusTable() *jobStatusTable {
+	return &jobStatusTable{
+		entries:  make(map[string]*JobStatus),
+		finished: make([]string, 0),
+	}
+}
+
+func (t *jobStatusTable) set(job *Job, state JobState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[job.Id]
+	if !ok {
+		entry = &JobStatus{
+			Id:     job.Id,
+			Origin: job.Origin,
+		}
+		t.entries[job.Id] = entry
+	}
+
+	entry.State = state
+	entry.Error = ""
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	// Jobs retried from the dead letters keep their id, so a job may
+	// finish more than once. It is only ever listed once, as of the
+	// last time it finished, and not while it is live again
+	if i := slices.Index(t.finished, job.Id); i >= 0 {
+		t.finished = slices.Delete(t.finished, i, i+1)
+	}
+
+	if !state.finished() {
+		return
+	}
+
+	t.finished = append(t.finished, job.Id)
+	for len(t.finished) > maxRetainedJobStatus {
+		delete(t.entries, t.finished[0])
+		t.finished = t.finished[1:]
+	}
+}
+
+func (t *jobStatusTable) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, id)
+}
+
+func (t *jobStatusTable) get(id string) (JobStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[id]
+	if !ok {
+		return JobStatus{}, false
+	}
+	return *entry, true
+}
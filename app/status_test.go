@@ -0,0 +1,37 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJobStatusRefinished(t *testing.T) {
+
+	table := newJobStatusTable()
+
+	retried := &Job{Id: "retried"}
+	table.set(retried, JobFailed, nil)
+
+	// Retried from the dead letters, and finished again
+	table.set(retried, JobQueued, nil)
+	table.set(retried, JobSucceeded, nil)
+
+	if len(table.finished) != 1 {
+		t.Fatalf("expected the job to be listed once, got %v", table.finished)
+	}
+
+	// Every other job finishing before it has to be forgotten first
+	for i := 0; i < maxRetainedJobStatus-1; i++ {
+		table.set(&Job{Id: fmt.Sprint(i)}, JobSucceeded, nil)
+	}
+
+	if _, ok := table.get("retried"); !ok {
+		t.Fatal("status forgotten while within the retained limit")
+	}
+
+	table.set(&Job{Id: "last"}, JobSucceeded, nil)
+
+	if _, ok := table.get("retried"); ok {
+		t.Fatal("oldest status was not forgotten")
+	}
+}
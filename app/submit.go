@@ -11,18 +11,24 @@ package app
 */
 
 import (
-	"bytes"
+	"errors"
 	"github.com/bosley/emrs/api"
+	"github.com/bosley/emrs/datastore"
 	"github.com/gin-gonic/gin"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (a *App) setupSubmit(gins *gin.Engine) {
 
 	grp := gins.Group("/submit")
 	grp.Use(a.SubmitAuthentication())
-	grp.POST("/event", a.submitEvent)
+	grp.POST("/event", a.SubmitRateLimit(), a.submitEvent)
+	grp.GET("/job/:id", a.submitJobStatus)
 }
 
 func (a *App) SubmitAuthentication() gin.HandlerFunc {
@@ -43,6 +49,30 @@ func (a *App) SubmitAuthentication() gin.HandlerFunc {
 	}
 }
 
+// Refuse submissions from an asset that is over its rate limit,
+// telling it when to try again
+func (a *App) SubmitRateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		origin := c.GetHeader("origin")
+		route := strings.Split(c.GetHeader("route"), ".")
+
+		wait, ok := a.limiter.allow(origin, route, a.assetRateLimits(origin), time.Now())
+		if ok {
+			return
+		}
+
+		slog.Warn("submission throttled", "origin", origin, "route", c.GetHeader("route"))
+
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"status":  "too many requests",
+			"message": "submission rate limit exceeded",
+		})
+		c.Abort()
+	}
+}
+
 func (a *App) submitEvent(c *gin.Context) {
 
 	slog.Debug("EVENT SUBMITTED", "body", c.Request.Body)
@@ -66,28 +96,306 @@ func (a *App) submitEvent(c *gin.Context) {
 		return
 	}
 
-	data := new(bytes.Buffer)
-	data.ReadFrom(c.Request.Body)
+	tags, err := api.DecomposeTags(c.GetHeader("tags"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "bad tags",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	data, err := readPayload(c.Request, a.maxBodySize)
+	if err != nil {
+		respondPayloadError(c, err)
+		return
+	}
+
+	slog.Info("event submission request", "route", route, "size", len(data))
+
+	received := time.Now()
+
+	headers := eventHeaders(c.Request.Header)
+
+	// Handlers are given the data as it was before it was compressed
+	delete(headers, "Content-Encoding")
+
+	submission := datastore.Submission{
+		Received: received,
+		Headers:  headers,
+		Version:  c.GetHeader(eventVersionHeader),
+		Tags:     tags,
+	}
+
+	// Repeats of a submission are answered with the jobs of the first
+	key := c.GetHeader(api.IdempotencyKeyHeader)
+	if key != "" {
+		previous, claimed, err := a.claimIdempotencyKey(origin, key, received)
+		if errors.Is(err, ErrBadIdempotencyKey) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "bad idempotency key",
+				"message": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				"status": "failed to check idempotency key",
+				"error":  err.Error(),
+			})
+			return
+		}
+		if !claimed && len(previous.Missing) > 0 {
+			a.resumeSubmission(c, previous, data, submission)
+			return
+		}
+		if !claimed {
+			respondDuplicate(c, previous)
+			return
+		}
+	}
+
+	// Routes in the routing table may fan out to several
+	// handlers, each of which is given its own job
+	destinations, routed := a.routes.resolve(route)
+	if !routed {
+		destinations = [][]string{route}
+	}
+
+	event := a.recordEvent(origin, route, data, submission, len(destinations))
 
-	slog.Info("event submission request", "route", route, "body", data)
+	jobs, missing, err := a.submitJobs(origin, destinations, data, submission, event)
+	if err != nil {
+		if len(jobs) == 0 {
+			// Nothing was submitted, so the submission can be made again
+			a.releaseIdempotencyKey(origin, key)
+		} else {
+			// Repeats of the submission only create the jobs that are missing
+			a.completeIdempotencyKey(origin, key, event, jobs, missing)
+		}
+		respondSubmitError(c, err, jobs)
+		return
+	}
 
-	// Submit the job
+	a.completeIdempotencyKey(origin, key, event, jobs, nil)
+
+	// Complete
 	//
-	if err := a.runner.SubmitJob(&Job{
-		Origin:      origin,
-		Destination: route,
-		Data:        data.Bytes(),
-	}); err != nil {
+	c.JSON(200, gin.H{
+		"status": "accepted",
+		"event":  event,
+		"job":    jobs[0],
+		"jobs":   jobs,
+	})
+}
+
+// Hand a job for each destination to the runner, stopping at the first that
+// can't be submitted. The ids of the jobs submitted are returned along with
+// the destinations that were not, which are counted as failures of the event
+func (a *App) submitJobs(origin string, destinations [][]string, data []byte, submission datastore.Submission, event string) ([]string, [][]string, error) {
+
+	jobs := make([]string, 0, len(destinations))
+	for i, destination := range destinations {
+
+		job := &Job{
+			Origin:      origin,
+			Destination: destination,
+			Data:        data,
+			Received:    submission.Received,
+			Headers:     submission.Headers,
+			Version:     submission.Version,
+			Tags:        submission.Tags,
+			Event:       event,
+		}
+
+		if err := a.runner.SubmitJob(job); err != nil {
+			if event != "" {
+				for range destinations[i:] {
+					a.db.CompleteEventJob(event, err.Error())
+				}
+			}
+			return jobs, destinations[i:], err
+		}
+		jobs = append(jobs, job.Id)
+	}
+	return jobs, nil, nil
+}
+
+// Create the jobs that the first attempt at a submission could not. Only one
+// repeat creates them, others are answered as though it is still in progress
+func (a *App) resumeSubmission(c *gin.Context, previous datastore.IdempotencyKey, data []byte, submission datastore.Submission) {
+
+	resumed, err := a.resumeIdempotencyKey(previous, submission.Received)
+	if err != nil {
 		c.JSON(500, gin.H{
-			"status": "failed to submit job for execution",
+			"status": "failed to check idempotency key",
 			"error":  err.Error(),
 		})
 		return
 	}
+	if !resumed {
+		respondInProgress(c)
+		return
+	}
+
+	destinations := make([][]string, 0, len(previous.Missing))
+	for _, route := range previous.Missing {
+		destinations = append(destinations, strings.Split(route, "."))
+	}
+
+	// The missing jobs were counted as failures of the event
+	if previous.Event != "" {
+		for range destinations {
+			a.db.ReopenEventJob(previous.Event)
+		}
+	}
+
+	slog.Info("resuming submission", "origin", previous.Origin, "event", previous.Event, "missing", len(destinations))
+
+	submitted, missing, err := a.submitJobs(previous.Origin, destinations, data, submission, previous.Event)
+
+	jobs := append(previous.Jobs, submitted...)
+	a.completeIdempotencyKey(previous.Origin, previous.Key, previous.Event, jobs, missing)
+
+	if err != nil {
+		respondSubmitError(c, err, jobs)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status": "accepted",
+		"event":  previous.Event,
+		"job":    jobs[0],
+		"jobs":   jobs,
+	})
+}
+
+func respondPayloadError(c *gin.Context, err error) {
+
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"status":  "payload too large",
+			"message": err.Error(),
+		})
+	case errors.Is(err, ErrUnsupportedEncoding):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"status":  "unsupported encoding",
+			"message": err.Error(),
+		})
+	case errors.Is(err, ErrMalformedPayload):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "malformed payload",
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "failed to read payload",
+			"message": err.Error(),
+		})
+	}
+}
+
+// Record the jobs created for a submission against its idempotency key,
+// along with the destinations of any jobs that could not be submitted
+func (a *App) completeIdempotencyKey(origin string, key string, event string, jobs []string, missing [][]string) {
+	if key == "" {
+		return
+	}
+	routes := make([]string, 0, len(missing))
+	for _, destination := range missing {
+		routes = append(routes, strings.Join(destination, "."))
+	}
+	a.db.CompleteIdempotencyKey(datastore.IdempotencyKey{
+		Origin:  origin,
+		Key:     key,
+		Event:   event,
+		Jobs:    jobs,
+		Missing: routes,
+	})
+}
+
+// Give up the key of a submission that could not be completed
+func (a *App) releaseIdempotencyKey(origin string, key string) {
+	if key == "" {
+		return
+	}
+	a.db.ReleaseIdempotencyKey(origin, key)
+}
+
+// Answer a repeated submission with what became of the first. If the
+// first is still being submitted there is nothing to answer with yet
+func respondDuplicate(c *gin.Context, previous datastore.IdempotencyKey) {
+
+	if len(previous.Jobs) == 0 {
+		respondInProgress(c)
+		return
+	}
+
+	slog.Info("repeated submission", "origin", previous.Origin, "event", previous.Event)
+
+	c.JSON(200, gin.H{
+		"status":    "accepted",
+		"duplicate": true,
+		"event":     previous.Event,
+		"job":       previous.Jobs[0],
+		"jobs":      previous.Jobs,
+	})
+}
+
+func respondInProgress(c *gin.Context) {
+	c.JSON(http.StatusConflict, gin.H{
+		"status":  "submission in progress",
+		"message": "a submission with this idempotency key has not completed",
+	})
+}
+
+// Report a job that could not be submitted, along with any jobs
+// for the same event that were submitted before it
+func respondSubmitError(c *gin.Context, err error, submitted []string) {
+
+	if errors.Is(err, ErrQueueFull) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "server busy",
+			"error":  err.Error(),
+			"jobs":   submitted,
+		})
+		return
+	}
+	if errors.Is(err, ErrRunnerStopped) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "server shutting down",
+			"error":  err.Error(),
+			"jobs":   submitted,
+		})
+		return
+	}
+	c.JSON(500, gin.H{
+		"status": "failed to submit job for execution",
+		"error":  err.Error(),
+		"jobs":   submitted,
+	})
+}
+
+// Report the state of a job previously submitted by the requesting
+// asset. Jobs belonging to other assets are reported as unknown
+func (a *App) submitJobStatus(c *gin.Context) {
+
+	origin := c.GetHeader("origin")
+	id := c.Param("id")
+
+	status, err := a.runner.JobStatus(id)
+	if err != nil || status.Origin != origin {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "not found",
+			"message": ErrUnknownJob.Error(),
+		})
+		return
+	}
 
-	// Complete
-	//
 	c.JSON(200, gin.H{
-		"status": "under construction",
+		"id":    status.Id,
+		"state": status.State,
+		"error": status.Error,
 	})
 }
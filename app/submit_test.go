@@ -0,0 +1,129 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bosley/emrs/api"
+	"github.com/bosley/emrs/datastore"
+	"github.com/gin-gonic/gin"
+)
+
+// Accepts every job, keeping them rather than running them
+type submitRunner struct {
+	Runner
+	submitted []*Job
+}
+
+func (r *submitRunner) SubmitJob(job *Job) error {
+	job.Id = strings.Join(job.Destination, ".")
+	r.submitted = append(r.submitted, job)
+	return nil
+}
+
+func submitWithKey(t *testing.T, a *App, key string) (int, map[string]interface{}) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/submit/event", bytes.NewReader([]byte(`{"open": true}`)))
+	c.Request.Header.Set("origin", "asset")
+	c.Request.Header.Set("route", "door.open")
+	c.Request.Header.Set("Content-Type", ContentJSON)
+	c.Request.Header.Set(api.IdempotencyKeyHeader, key)
+
+	a.submitEvent(c)
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code, body
+}
+
+func TestSubmitPartialFanOut(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	db, err := datastore.Load(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	routes, err := buildRouteTable(map[string][]string{
+		"door.open": {"alert.Sms", "logger.Log", "audit.Record"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue fills after the first job is submitted
+	runner := &submitRunner{}
+	a := &App{db: db, runner: &fillingRunner{submitRunner: runner, room: 1}, routes: routes}
+
+	code, body := submitWithKey(t, a, "attempt")
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the submission to fail, got %d: %v", code, body)
+	}
+	if len(runner.submitted) != 1 {
+		t.Fatalf("expected one job to be submitted, got %d", len(runner.submitted))
+	}
+
+	// A repeat only creates the jobs that are missing, for the same event
+	a.runner = runner
+	code, body = submitWithKey(t, a, "attempt")
+	if code != http.StatusOK {
+		t.Fatalf("expected the repeat to be accepted, got %d: %v", code, body)
+	}
+
+	routesRun := make([]string, 0)
+	events := make(map[string]bool)
+	for _, job := range runner.submitted {
+		routesRun = append(routesRun, strings.Join(job.Destination, "."))
+		events[job.Event] = true
+	}
+	if !slices.Equal(routesRun, []string{"alert.Sms", "logger.Log", "audit.Record"}) {
+		t.Fatalf("expected each destination to be submitted once, got %v", routesRun)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected every job to belong to one event, got %v", events)
+	}
+	if jobs, _ := body["jobs"].([]interface{}); len(jobs) != 3 {
+		t.Fatalf("expected the repeat to report all three jobs, got %v", body["jobs"])
+	}
+
+	// The event is pending again until the jobs created for it finish
+	recorded, err := db.GetEvents(datastore.EventFilter{})
+	if err != nil || len(recorded) != 1 {
+		t.Fatalf("expected one recorded event, got %v (%v)", recorded, err)
+	}
+	if recorded[0].Outcome != datastore.EventPending {
+		t.Fatalf("expected the event to be pending, got %s", recorded[0].Outcome)
+	}
+
+	// Later repeats are duplicates
+	code, body = submitWithKey(t, a, "attempt")
+	if code != http.StatusOK || body["duplicate"] != true || len(runner.submitted) != 3 {
+		t.Fatalf("expected a duplicate, got %d: %v", code, body)
+	}
+}
+
+// Takes a number of jobs, then reports the queue is full
+type fillingRunner struct {
+	*submitRunner
+	room int
+}
+
+func (r *fillingRunner) SubmitJob(job *Job) error {
+	if r.room <= 0 {
+		return ErrQueueFull
+	}
+	r.room--
+	return r.submitRunner.SubmitJob(job)
+}
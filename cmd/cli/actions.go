@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bosley/emrs/app/emrstest"
+	"github.com/bosley/emrs/badger"
+	"github.com/bosley/emrs/datastore"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	actionLoaded    = "loaded"
+	actionNotLoaded = "not loaded"
+	actionDisabled  = "disabled"
+	actionUnknown   = "unknown" // The server could not be reached
+)
+
+// Exit unless the source would load on the server as the named action,
+// listing the handlers it offers otherwise
+func mustValidateAction(home string, name string, location string, capabilities []string) {
+
+	importPath, err := sourceImportPath(name, location)
+	if err != nil {
+		slog.Error("failed to read action source", "source", location, "error", err.Error())
+		os.Exit(1)
+	}
+
+	report, err := validateAction(home, name, location, importPath, capabilities)
+	if err != nil {
+		slog.Error("action failed validation, it has not been installed", "source", location, "error", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println("handlers:", strings.Join(report.Handlers, ", "))
+}
+
+func validateAction(home string, name string, location string, importPath string, capabilities []string) (emrstest.Report, error) {
+	return emrstest.Validate(
+		emrstest.Action{
+			Name:         name,
+			Source:       location,
+			ImportPath:   importPath,
+			Capabilities: capabilities,
+		},
+		emrstest.Options{
+			GoPath: filepath.Join(home, defaultActionsDir),
+		})
+}
+
+// Whether an installed path is somewhere the cli put it, and so is
+// safe to remove. Actions can be pointed elsewhere by hand
+func withinActionsDir(home string, path string) bool {
+	rel, err := filepath.Rel(filepath.Join(home, defaultActionsDir), path)
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+// The loaded state of the actions is retrieved from the local server,
+// which requires the owner's password. The password is only asked for
+// if the server can be reached, otherwise the rest of the listing is
+// still given. Handlers are found by reading each action's source, so
+// nothing in the actions is run
+func executeListActions(home string) {
+
+	cfg, badge := mustLoadCfgAndBadge(home)
+
+	if len(cfg.Actions) == 0 {
+		fmt.Println("There are no actions installed")
+		return
+	}
+
+	var loaded []string
+	if serverReachable(cfg.Binding) {
+		loaded = queryLoadedActions(home, cfg, badge)
+	} else {
+		slog.Warn("unable to reach the server, the loaded state of actions is unknown", "binding", cfg.Binding)
+	}
+
+	names := make([]string, 0, len(cfg.Actions))
+	for name := range cfg.Actions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		path := cfg.Actions[name]
+
+		state := actionUnknown
+		switch {
+		case slices.Contains(cfg.Disabled, name):
+			state = actionDisabled
+		case loaded == nil:
+		case slices.Contains(loaded, name):
+			state = actionLoaded
+		default:
+			state = actionNotLoaded
+		}
+
+		handlers := ""
+		found, err := emrstest.Handlers(path)
+		if err != nil {
+			handlers = "invalid: " + err.Error()
+		} else {
+			handlers = strings.Join(found, ", ")
+		}
+
+		fmt.Printf("%s | %s | %s | %s\n", name, state, path, handlers)
+	}
+}
+
+// Whether anything is listening at the server's binding
+func serverReachable(binding string) bool {
+	conn, err := net.DialTimeout("tcp", binding, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Ask the server which actions it has loaded, authenticating the owner
+// first. Nil is returned if the server could not say
+func queryLoadedActions(home string, cfg Config, badge badger.Badge) []string {
+
+	dataStrj, err := datastore.Load(filepath.Join(home, defaultStoragePath))
+	if err != nil {
+		slog.Error("failed to load datastore", "error", err.Error())
+		os.Exit(1)
+	}
+
+	defer dataStrj.Close()
+
+	// Only the stored cnc key is used, listing never asks for the password
+	o, err := dataStrj.GetOwner()
+	if err != nil || !badger.ValidateVoucher(badge.PublicKey(), o.UiKey) {
+		slog.Warn("no valid cnc key is stored, the loaded state of actions is unknown")
+		return nil
+	}
+
+	client := mustBuildCncClient(cfg, badge, dataStrj)
+
+	loaded, err := client.Actions()
+	if err != nil {
+		slog.Warn("unable to retrieve loaded actions from the server", "error", err.Error())
+		return nil
+	}
+	return loaded
+}
+
+func executeRemoveAction(cfg Config, home string, name string) {
+
+	path, ok := cfg.Actions[name]
+	if !ok {
+		slog.Error("no action installed with that name", "name", name)
+		os.Exit(1)
+	}
+
+	delete(cfg.Actions, name)
+	cfg.Disabled = slices.DeleteFunc(cfg.Disabled, func(n string) bool { return n == name })
+
+	mustWriteConfig(home, cfg)
+
+	removeActionSource(cfg, home, path)
+
+	fmt.Println("removed:", name)
+}
+
+// Delete an action's installed source, unless it lives outside of the
+// actions directory or another action still uses it
+func removeActionSource(cfg Config, home string, path string) {
+
+	for other, otherPath := range cfg.Actions {
+		if otherPath == path {
+			slog.Warn("not removing action source, it is used by another action", "path", path, "action", other)
+			return
+		}
+	}
+
+	if !withinActionsDir(home, path) {
+		slog.Warn("not removing action source, it is outside of the actions directory", "path", path)
+		return
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		slog.Error("failed to remove action source", "path", path, "error", err.Error())
+		os.Exit(1)
+	}
+}
+
+func executeUpdateAction(cfg Config, home string, name string, location string) {
+
+	previous, ok := cfg.Actions[name]
+	if !ok {
+		slog.Error("no action installed with that name, use `--new` to install it", "name", name)
+		os.Exit(1)
+	}
+
+	mustValidateAction(home, name, location, cfg.Capabilities[name])
+
+	destination, err := installSource(home, name, location, cfg.Actions)
+	if err != nil {
+		slog.Error("failed to install action", "source", location, "destination", destination, "error", err.Error())
+		os.Exit(1)
+	}
+
+	cfg.Actions[name] = destination
+
+	mustWriteConfig(home, cfg)
+
+	if previous != destination {
+		removeActionSource(cfg, home, previous)
+	}
+
+	fmt.Println("updated:", name)
+}
+
+func executeSetActionEnabled(cfg Config, home string, name string, enabled bool) {
+
+	if _, ok := cfg.Actions[name]; !ok {
+		slog.Error("no action installed with that name", "name", name)
+		os.Exit(1)
+	}
+
+	disabled := slices.Contains(cfg.Disabled, name)
+	switch {
+	case enabled && disabled:
+		cfg.Disabled = slices.DeleteFunc(cfg.Disabled, func(n string) bool { return n == name })
+	case !enabled && !disabled:
+		cfg.Disabled = append(cfg.Disabled, name)
+	default:
+		fmt.Println("no change")
+		return
+	}
+
+	mustWriteConfig(home, cfg)
+
+	if enabled {
+		fmt.Println("enabled:", name)
+	} else {
+		fmt.Println("disabled:", name)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bosley/emrs/app"
+	"strings"
+	"time"
+)
+
+// Settings for the pool that executes jobs. Zero values
+// are replaced by the server's defaults
+type RunnerConfig struct {
+	Workers    int    `yaml:"workers"`
+	QueueSize  int    `yaml:"queue_size"`
+	JobTimeout string `yaml:"job_timeout"`
+}
+
+// What actions write to stdout, stderr and emrs.Log is kept in memory,
+// `Lines` per action. With `Save` it is also appended to a file
+// per action in the logs directory of the EMRS home
+type OutputConfig struct {
+	Lines int  `yaml:"lines"`
+	Save  bool `yaml:"save"`
+}
+
+// Every accepted event is recorded. Its data is only kept with `Payloads`,
+// and then only the first `MaxPayload` bytes (4096 if not set)
+type EventsConfig struct {
+	Payloads   bool `yaml:"payloads"`
+	MaxPayload int  `yaml:"max_payload"`
+}
+
+// Limits on how often each asset may submit events. `Routes` is keyed by
+// route prefix like RetryConfig. Limits for specific assets are kept in
+// the datastore (see `emrs asset --limit`)
+type RateLimitConfig struct {
+	Default RateLimitEntry            `yaml:"default"`
+	Routes  map[string]RateLimitEntry `yaml:"routes"`
+}
+
+// Up to `Burst` submissions at once, refilled at `Rate` a second
+type RateLimitEntry struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// Retry policies for failing jobs. `Routes` is keyed by route
+// prefix, so an entry may cover an action or a specific route
+type RetryConfig struct {
+	Default RetryPolicyConfig            `yaml:"default"`
+	Routes  map[string]RetryPolicyConfig `yaml:"routes"`
+}
+
+type RetryPolicyConfig struct {
+	Attempts   int    `yaml:"attempts"`
+	Backoff    string `yaml:"backoff"`
+	MaxBackoff string `yaml:"max_backoff"`
+}
+
+// Invokes `route` (action.Function) either `every` interval (ex: 5m)
+// or whenever the `cron` expression (ex: "0 8 * * *") is due
+type ScheduleConfig struct {
+	Every string `yaml:"every"`
+	Cron  string `yaml:"cron"`
+	Route string `yaml:"route"`
+	Data  string `yaml:"data"`
+}
+
+func (r RunnerConfig) toOpts() (app.RunnerOpts, error) {
+	opts := app.RunnerOpts{
+		Workers:   r.Workers,
+		QueueSize: r.QueueSize,
+	}
+	d, err := parseOptionalDuration(r.JobTimeout)
+	if err != nil {
+		return opts, err
+	}
+	opts.JobTimeout = d
+	return opts, nil
+}
+
+func (r RetryConfig) applyTo(opts *app.RunnerOpts) error {
+	policy, err := r.Default.toPolicy()
+	if err != nil {
+		return err
+	}
+	opts.Retry = policy
+	opts.Retries = make(map[string]app.RetryPolicy)
+	for route, entry := range r.Routes {
+		policy, err := entry.toPolicy()
+		if err != nil {
+			return err
+		}
+		opts.Retries[route] = policy
+	}
+	return nil
+}
+
+func (p RetryPolicyConfig) toPolicy() (app.RetryPolicy, error) {
+	policy := app.RetryPolicy{
+		Attempts: p.Attempts,
+	}
+	backoff, err := parseOptionalDuration(p.Backoff)
+	if err != nil {
+		return policy, err
+	}
+	limit, err := parseOptionalDuration(p.MaxBackoff)
+	if err != nil {
+		return policy, err
+	}
+	policy.Backoff = backoff
+	policy.MaxBackoff = limit
+	return policy, nil
+}
+
+func (r RateLimitConfig) toLimits() app.RateLimits {
+	limits := app.RateLimits{
+		Default: app.RateLimit(r.Default),
+		Routes:  make(map[string]app.RateLimit),
+	}
+	for route, entry := range r.Routes {
+		limits.Routes[route] = app.RateLimit(entry)
+	}
+	return limits
+}
+
+func toSchedules(config map[string]ScheduleConfig) (map[string]app.Schedule, error) {
+	schedules := make(map[string]app.Schedule)
+	for name, entry := range config {
+		every, err := parseOptionalDuration(entry.Every)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", name, err)
+		}
+		schedules[name] = app.Schedule{
+			Every: every,
+			Cron:  entry.Cron,
+			Route: entry.Route,
+			Data:  []byte(entry.Data),
+		}
+	}
+	return schedules, nil
+}
+
+func toConcurrency(config map[string]string) (map[string]app.Concurrency, error) {
+	limits := make(map[string]app.Concurrency)
+	for action, setting := range config {
+		limit, err := app.ParseConcurrency(setting)
+		if err != nil {
+			return nil, fmt.Errorf("action %s: %w", action, err)
+		}
+		limits[action] = limit
+	}
+	return limits, nil
+}
+
+// Durations left empty in the config are returned as zero
+// so the server can fill them in with its defaults
+func parseOptionalDuration(value string) (time.Duration, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bosley/emrs/datastore"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	deadLetterAll = "all"
+)
+
+func cliDeadLetter() {
+	deadCmd := flag.NewFlagSet("deadletter", flag.ExitOnError)
+	list := deadCmd.Bool("list", false, "List jobs that failed all of their attempts")
+	retry := deadCmd.String("retry", "", "Re-submit a dead letter by its job id, or 'all'")
+	purge := deadCmd.String("purge", "", "Remove a dead letter by its job id, or 'all'")
+	emrsHome := deadCmd.String("home", "", "Home directory")
+
+	deadCmd.Parse(os.Args[2:])
+
+	*emrsHome = mustFindHome(*emrsHome)
+
+	if !*list && strings.TrimSpace(*retry) == "" && strings.TrimSpace(*purge) == "" {
+		fmt.Println("no valid arguments given to deadletter")
+		return
+	}
+
+	dataStrj, err := datastore.Load(filepath.Join(*emrsHome, defaultStoragePath))
+	if err != nil {
+		slog.Error("failed to load datastore", "error", err.Error())
+		os.Exit(1)
+	}
+
+	mustAuthenticateOwner(dataStrj)
+
+	cfg, badge := mustLoadCfgAndBadge(*emrsHome)
+
+	client := mustBuildCncClient(cfg, badge, dataStrj)
+
+	if *list {
+		letters, err := client.DeadLetters()
+		if err != nil {
+			slog.Error("failed to retrieve dead letters", "error", err.Error())
+			os.Exit(1)
+		}
+		if len(letters) == 0 {
+			fmt.Println("There are no dead letters")
+			return
+		}
+		for i, l := range letters {
+			fmt.Printf("%6d | %s | %s | %s | attempts: %d | %s\n",
+				i, l.Id, l.Origin, l.Route, l.Attempts, l.Error)
+		}
+		return
+	}
+
+	if strings.TrimSpace(*retry) != "" {
+		count, err := client.RetryDeadLetters(deadLetterTarget(*retry))
+		if err != nil {
+			slog.Error("failed to retry dead letters", "error", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("retried:", count)
+		return
+	}
+
+	count, err := client.PurgeDeadLetters(deadLetterTarget(*purge))
+	if err != nil {
+		slog.Error("failed to purge dead letters", "error", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("purged:", count)
+}
+
+// The CNC api takes an empty id to mean every dead letter
+func deadLetterTarget(given string) string {
+	if strings.TrimSpace(given) == deadLetterAll {
+		return ""
+	}
+	return strings.TrimSpace(given)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bosley/emrs/api"
+	"github.com/bosley/emrs/datastore"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultEventsLimit = 50
+
+func cliEvents() {
+	eventsCmd := flag.NewFlagSet("events", flag.ExitOnError)
+	asset := eventsCmd.String("asset", "", "Only events submitted by this asset (id or name)")
+	route := eventsCmd.String("route", "", "Only events submitted to this route, or routes beginning with it")
+	since := eventsCmd.String("since", "", "Only events received since this time (RFC3339), or this long ago (ex: 2h)")
+	until := eventsCmd.String("until", "", "Only events received until this time (RFC3339), or this long ago")
+	status := eventsCmd.String("status", "", "Only events with this outcome [pending succeeded failed]")
+	limit := eventsCmd.Int("limit", defaultEventsLimit, "Show at most this many of the most recent events (0 for all)")
+	payload := eventsCmd.Bool("payload", false, "Show what was kept of the data submitted with each event")
+	replay := eventsCmd.Bool("replay", false, "Submit the matching events again through the current actions")
+	to := eventsCmd.String("to", "", "With --replay, send the events to this route instead of their own")
+	emrsHome := eventsCmd.String("home", "", "Home directory")
+
+	eventsCmd.Parse(os.Args[2:])
+
+	*emrsHome = mustFindHome(*emrsHome)
+
+	// Replays cover every matching event unless told otherwise
+	if *replay && !flagGiven(eventsCmd, "limit") {
+		*limit = 0
+	}
+
+	if *to != "" && !*replay {
+		slog.Error("--to is only used with --replay")
+		os.Exit(1)
+	}
+
+	query := api.EventQuery{
+		Route:  strings.TrimSpace(*route),
+		Status: strings.TrimSpace(*status),
+		Limit:  *limit,
+	}
+
+	var err error
+	if query.Since, err = parseEventTime(*since); err != nil {
+		slog.Error("invalid --since", "error", err.Error())
+		os.Exit(1)
+	}
+	if query.Until, err = parseEventTime(*until); err != nil {
+		slog.Error("invalid --until", "error", err.Error())
+		os.Exit(1)
+	}
+
+	dataStrj, err := datastore.Load(filepath.Join(*emrsHome, defaultStoragePath))
+	if err != nil {
+		slog.Error("failed to load datastore", "error", err.Error())
+		os.Exit(1)
+	}
+
+	query.Asset = assetIdFromName(dataStrj, strings.TrimSpace(*asset))
+
+	mustAuthenticateOwner(dataStrj)
+
+	cfg, badge := mustLoadCfgAndBadge(*emrsHome)
+
+	client := mustBuildCncClient(cfg, badge, dataStrj)
+
+	if *replay {
+		executeReplayEvents(client, query, strings.TrimSpace(*to))
+		return
+	}
+
+	events, err := client.Events(query)
+	if err != nil {
+		slog.Error("failed to retrieve events", "error", err.Error())
+		os.Exit(1)
+	}
+
+	if len(events) == 0 {
+		fmt.Println("There are no matching events")
+		return
+	}
+
+	for _, e := range events {
+		fmt.Printf("%s | %s | %s | %s | %d bytes | %s",
+			e.Received.Format(time.RFC3339), e.Id, e.Origin, e.Route, e.Size, e.Outcome)
+		if e.Error != "" {
+			fmt.Printf(" | %s", e.Error)
+		}
+		fmt.Println()
+		if *payload && len(e.Payload) > 0 {
+			fmt.Printf("    %q\n", e.Payload)
+		}
+	}
+}
+
+func executeReplayEvents(client api.CNCApi, query api.EventQuery, route string) {
+
+	result, err := client.ReplayEvents(query, route)
+	if err != nil {
+		slog.Error("failed to replay events", "error", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println("replayed:", result.Replayed, "jobs:", len(result.Jobs))
+	if result.Skipped > 0 {
+		fmt.Println("skipped:", result.Skipped, "(their data was not kept, see `events` in server.cfg)")
+	}
+}
+
+func flagGiven(set *flag.FlagSet, name string) bool {
+	given := false
+	set.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// Times are given as RFC3339, or as a duration before now
+func parseEventTime(given string) (time.Time, error) {
+	given = strings.TrimSpace(given)
+	if given == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(given); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, given)
+}
+
+// Assets may be given by name, in which case the id of the asset
+// with that name is used. Otherwise the given value is taken as the id
+func assetIdFromName(db datastore.DataStore, given string) string {
+	for _, asset := range db.GetAssets() {
+		if asset.DisplayName == given {
+			return asset.Id
+		}
+	}
+	return given
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where packages are installed so that the interpreter
+// can resolve imports between them (GOPATH layout)
+const defaultActionsSrcDir = "src"
+
+// Install an action or library source into the actions directory, returning
+// where it was placed. Single files are copied into the actions directory as
+// they always have been. Directories are copied into the actions GOPATH under
+// their module path if they have a go.mod, or under the given name otherwise.
+// Nothing is installed over the source of another of the installed actions
+func installSource(home string, name string, location string, installed map[string]string) (string, error) {
+
+	info, err := os.Stat(location)
+	if err != nil {
+		return "", err
+	}
+
+	actionsDir := filepath.Join(home, defaultActionsDir)
+
+	if !info.IsDir() {
+		destination := filepath.Join(actionsDir, filepath.Base(location))
+		if sameLocation(location, destination) {
+			return destination, nil
+		}
+		if err := checkInstallOwner(installed, name, destination); err != nil {
+			return destination, err
+		}
+		_, err := copyFile(location, destination)
+		return destination, err
+	}
+
+	importPath, err := sourceImportPath(name, location)
+	if err != nil {
+		return "", err
+	}
+
+	destination := filepath.Join(actionsDir, defaultActionsSrcDir, filepath.FromSlash(importPath))
+
+	// Already installed in place (ex: edited within the actions directory)
+	if sameLocation(location, destination) {
+		return destination, nil
+	}
+
+	if err := checkInstallOwner(installed, name, destination); err != nil {
+		return destination, err
+	}
+
+	// Replace rather than merge so that files removed
+	// from the source do not linger in the installation
+	if err := os.RemoveAll(destination); err != nil {
+		return "", err
+	}
+	return destination, copyDir(location, destination)
+}
+
+// Refuse a destination that holds the source of an installed action other
+// than the named one
+func checkInstallOwner(installed map[string]string, name string, destination string) error {
+	for other, path := range installed {
+		if other != name && sameLocation(path, destination) {
+			return fmt.Errorf("%s is the source of the installed action %s", destination, other)
+		}
+	}
+	return nil
+}
+
+func sameLocation(a string, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
+
+// Where a package directory is installed within the actions GOPATH.
+// Single files are not installed in the GOPATH, and keep their name
+func sourceImportPath(name string, location string) (string, error) {
+	if info, err := os.Stat(location); err != nil || !info.IsDir() {
+		return name, err
+	}
+	module, ok, err := readModulePath(location)
+	if err != nil || !ok {
+		return name, err
+	}
+	return module, nil
+}
+
+// Retrieve the module path declared by a directory's go.mod, if it has one
+func readModulePath(dir string) (string, bool, error) {
+
+	file, err := os.Open(filepath.Join(dir, "go.mod"))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if module, ok := strings.CutPrefix(line, "module "); ok {
+			return strings.Trim(strings.TrimSpace(module), `"`), true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", false, err
+	}
+	return "", false, fmt.Errorf("no module declared in %s", filepath.Join(dir, "go.mod"))
+}
+
+// Copy a directory tree, leaving out hidden files and directories (.git, ...)
+func copyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if rel != "." && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		_, err = copyFile(path, target)
+		return err
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/bosley/emrs/api"
 	"github.com/bosley/emrs/app"
+	"github.com/bosley/emrs/app/emrstest"
 	"github.com/bosley/emrs/badger"
 	"github.com/bosley/emrs/datastore"
 	"golang.org/x/term"
@@ -29,6 +30,7 @@ const (
 	defaultUserGivenDuration = "4320h" // ~6 months
 
 	defaultActionsDir = "actions"
+	defaultLogsDir    = "logs"
 )
 
 const (
@@ -41,6 +43,52 @@ type Config struct {
 	Cert     string            `yaml:cert`
 	Identity string            `yaml:identity`
 	Actions  map[string]string `yaml:actions`
+
+	// Signal name to the `action.Function` routes subscribed to it
+	Signals map[string][]string `yaml:"signals"`
+
+	Runner RunnerConfig `yaml:"runner"`
+	Retry  RetryConfig  `yaml:"retry"`
+
+	// How long the idempotency keys given with submissions
+	// are remembered (ex: 1h), 24h if not set
+	IdempotencyWindow string `yaml:"idempotency_window"`
+
+	// When set (ex: 2s), the actions are checked for changes at
+	// this interval and reloaded without restarting the server
+	WatchActions string `yaml:"watch_actions"`
+
+	// Action name to the capabilities (fs, net, exec, time, ..) it is
+	// permitted. Actions not listed may use the full standard library
+	Capabilities map[string][]string `yaml:"capabilities"`
+
+	// Named schedules that invoke actions without a submission
+	Schedules map[string]ScheduleConfig `yaml:"schedules"`
+
+	// Submitted route patterns to the `action.Function` routes handling them
+	Routes map[string][]string `yaml:"routes"`
+
+	// Pipeline name to the `action.Function` routes of its stages, in order
+	Pipelines map[string][]string `yaml:"pipelines"`
+
+	// Installed actions that the server does not load
+	Disabled []string `yaml:"disabled"`
+
+	// Action name to how many of its jobs may run at once:
+	// `serial`, `max N`, `per-origin serial` or `per-origin max N`
+	Concurrency map[string]string `yaml:"concurrency"`
+
+	// Capture of what actions print and log
+	Output OutputConfig `yaml:"output"`
+
+	// What is kept of each event accepted from an asset
+	Events EventsConfig `yaml:"events"`
+
+	// How often each asset may submit events
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// Largest body, in bytes, accepted with a submission (1MiB if not set)
+	MaxBodySize int64 `yaml:"max_body_size"`
 }
 
 func main() {
@@ -78,6 +126,12 @@ func main() {
 	case "stat":
 		cliStat()
 		break
+	case "deadletter":
+		cliDeadLetter()
+		break
+	case "events":
+		cliEvents()
+		break
 	case "doc":
 		cliDoc()
 		break
@@ -86,25 +140,18 @@ func main() {
 		fmt.Println(`
 
 
-      Available commands are [server asset action tokens submit cnc stat doc]
+      Available commands are [server asset action tokens submit cnc stat deadletter events doc]
 
       Use '--help' with one of the above commands for more information
 
-          example:      emrs server --help
-`)
+          example:      emrs server --help`)
 		os.Exit(1)
 	}
 	return
 }
 
 func getConfig(home string) Config {
-	var config Config
-	target, err := os.ReadFile(filepath.Join(home, defaultConfigName))
-	if err != nil {
-		slog.Error("failed to load config", "error", err.Error())
-		os.Exit(1)
-	}
-	err = yaml.Unmarshal(target, &config)
+	config, err := loadConfig(home)
 	if err != nil {
 		slog.Error("failed to load config", "error", err.Error())
 		os.Exit(1)
@@ -113,6 +160,16 @@ func getConfig(home string) Config {
 	return config
 }
 
+func loadConfig(home string) (Config, error) {
+	var config Config
+	target, err := os.ReadFile(filepath.Join(home, defaultConfigName))
+	if err != nil {
+		return config, err
+	}
+	err = yaml.Unmarshal(target, &config)
+	return config, err
+}
+
 func writeNewEmrs(home string, force bool, noHelp bool) {
 
 	slog.Info("creating new emrs instance", "home", home, "force", force)
@@ -170,6 +227,10 @@ func writeNewEmrs(home string, force bool, noHelp bool) {
 	cfg := Config{
 		Binding:  defaultBinding,
 		Identity: badge.EncodeIdentityString(),
+		Runner: RunnerConfig{
+			QueueSize:  app.DefaultRunnerQueueSize,
+			JobTimeout: app.DefaultRunnerJobTimeout.String(),
+		},
 	}
 
 	b, e := yaml.Marshal(&cfg)
@@ -237,6 +298,25 @@ func mustLoadCfgAndBadge(home string) (Config, badger.Badge) {
 	return cfg, badge
 }
 
+// Prompt for the owner's password and exit if it does not match
+func mustAuthenticateOwner(db datastore.DataStore) {
+	o, e := db.GetOwner()
+	if e != nil {
+		slog.Error("failed to retrieve owner for auth", "error", e.Error())
+		os.Exit(1)
+	}
+
+	userInput := mustGetPassword()
+
+	println("\r\n")
+
+	if err := badger.RawIsHashMatch(userInput, []byte(o.Hash)); err != nil {
+		slog.Error("authentication error", "error", err.Error())
+		os.Exit(7)
+	}
+	slog.Info("authentication complete")
+}
+
 func mustGetPassword() []byte {
 	fmt.Print("Password: ")
 	bytepw, err := term.ReadPassword(int(syscall.Stdin))
@@ -282,12 +362,87 @@ func cliServer() {
 		os.Exit(1)
 	}
 
+	runnerOpts, err := cfg.Runner.toOpts()
+	if err != nil {
+		slog.Error("invalid runner configuration", "error", err.Error())
+		os.Exit(1)
+	}
+
+	if err := cfg.Retry.applyTo(&runnerOpts); err != nil {
+		slog.Error("invalid retry configuration", "error", err.Error())
+		os.Exit(1)
+	}
+
+	runnerOpts.Capabilities = cfg.Capabilities
+	runnerOpts.Disabled = cfg.Disabled
+
+	runnerOpts.Concurrency, err = toConcurrency(cfg.Concurrency)
+	if err != nil {
+		slog.Error("invalid concurrency configuration", "error", err.Error())
+		os.Exit(1)
+	}
+
+	history := app.EventHistory{
+		Payloads:   cfg.Events.Payloads,
+		MaxPayload: cfg.Events.MaxPayload,
+	}
+
+	runnerOpts.OutputLines = cfg.Output.Lines
+	if cfg.Output.Save {
+		runnerOpts.OutputDir = filepath.Join(*emrsHome, defaultLogsDir)
+	}
+
+	watchInterval, err := parseOptionalDuration(cfg.WatchActions)
+	if err != nil {
+		slog.Error("invalid watch_actions interval", "error", err.Error())
+		os.Exit(1)
+	}
+
+	idempotencyWindow, err := parseOptionalDuration(cfg.IdempotencyWindow)
+	if err != nil {
+		slog.Error("invalid idempotency_window", "error", err.Error())
+		os.Exit(1)
+	}
+
+	schedules, err := toSchedules(cfg.Schedules)
+	if err != nil {
+		slog.Error("invalid schedule configuration", "error", err.Error())
+		os.Exit(1)
+	}
+
+	home := *emrsHome
+
 	emrs, launchErr := app.New(&app.Opts{
 		Badge:      badge,
 		Binding:    cfg.Binding,
 		DataStore:  dataStrj,
 		ActionMap:  cfg.Actions,
 		ActionPath: filepath.Join(*emrsHome, defaultActionsDir),
+		Signals:    cfg.Signals,
+		Runner:     runnerOpts,
+		LoadActionMap: func() (map[string]string, error) {
+			current, err := loadConfig(home)
+			if err != nil {
+				return nil, err
+			}
+			return current.Actions, nil
+		},
+		LoadDisabled: func() ([]string, error) {
+			current, err := loadConfig(home)
+			if err != nil {
+				return nil, err
+			}
+			return current.Disabled, nil
+		},
+		WatchActions: watchInterval,
+		Schedules:    schedules,
+		Routes:       cfg.Routes,
+		Pipelines:    cfg.Pipelines,
+		EventHistory: history,
+
+		IdempotencyWindow: idempotencyWindow,
+		RateLimits:        cfg.RateLimit.toLimits(),
+		MaxBodySize:       cfg.MaxBodySize,
 	})
 
 	if launchErr != nil {
@@ -313,6 +468,12 @@ func cliAsset() {
 	removeAsset := assetCmd.String("remove", "", "Remove an asset by its UUID")
 	updateAsset := assetCmd.String("update", "", "Update an asset's name given its UUID (requires --name)")
 	assetName := assetCmd.String("name", "[ASSET]", "Specify the name value")
+	limitAsset := assetCmd.String("limit", "", "Set the submission rate limit of an asset, by id or name (requires --rate)")
+	unlimitAsset := assetCmd.String("unlimit", "", "Remove a rate limit set for an asset, by id or name")
+	listLimits := assetCmd.Bool("limits", false, "List the rate limits set for assets")
+	limitRate := assetCmd.Float64("rate", -1, "Submissions per second with `--limit` (0 for no limit)")
+	limitBurst := assetCmd.Int("burst", 0, "Submissions that may be made at once with `--limit`")
+	limitRoute := assetCmd.String("route", "", "Only limit routes beginning with this one with `--limit` and `--unlimit`")
 	emrsHome := assetCmd.String("home", "", "Home directory")
 
 	assetCmd.Parse(os.Args[2:])
@@ -325,6 +486,18 @@ func cliAsset() {
 		os.Exit(1)
 	}
 
+	if *listLimits {
+		executeListRateLimits(dataStrj)
+		return
+	}
+	if strings.Trim(*limitAsset, " ") != "" {
+		executeSetRateLimit(dataStrj, *limitAsset, *limitRoute, *limitRate, *limitBurst)
+		return
+	}
+	if strings.Trim(*unlimitAsset, " ") != "" {
+		executeRemoveRateLimit(dataStrj, *unlimitAsset, *limitRoute)
+		return
+	}
 	if *listAssets {
 		assets := dataStrj.GetAssets()
 		if len(assets) == 0 {
@@ -373,16 +546,66 @@ func cliAsset() {
 
 func cliAction() {
 	actionCmd := flag.NewFlagSet("action", flag.ExitOnError)
-	createAction := actionCmd.String("new", "", "Install an action file (requires --name)")
+	createAction := actionCmd.String("new", "", "Install an action file, package directory, or module (requires --name)")
+	createLibrary := actionCmd.String("lib", "", "Install a package directory or module that actions may import (requires --name unless it is a module)")
 	actionName := actionCmd.String("name", "", "Set the name value for a corresponding command")
+	testAction := actionCmd.String("test", "", "Run the tests of an action file or package directory")
+	testRun := actionCmd.String("run", "", "Only run tests matching the expression with `--test`")
+	verbose := actionCmd.Bool("v", false, "Report every test run with `--test`")
+	listActions := actionCmd.Bool("list", false, "List installed actions, their handlers, and whether they are loaded")
+	removeAction := actionCmd.String("remove", "", "Uninstall an action by name")
+	updateAction := actionCmd.String("update", "", "Replace the source of an installed action (requires --name)")
+	disableAction := actionCmd.String("disable", "", "Keep an action installed, but stop the server from loading it")
+	enableAction := actionCmd.String("enable", "", "Let the server load a disabled action again")
+	showLogs := actionCmd.String("logs", "", "Show the recent output of an action on the local server")
+	follow := actionCmd.Bool("follow", false, "Keep showing output as it is written with `--logs`")
 	emrsHome := actionCmd.String("home", "", "Home directory")
 
 	actionCmd.Parse(os.Args[2:])
 
+	if strings.Trim(*testAction, " ") != "" {
+		executeTestAction(*emrsHome, *testAction, *testRun, *verbose)
+		return
+	}
+
 	*emrsHome = mustFindHome(*emrsHome)
 
+	if strings.Trim(*showLogs, " ") != "" {
+		executeActionLogs(*emrsHome, *showLogs, *follow)
+		return
+	}
+
+	if *listActions {
+		executeListActions(*emrsHome)
+		return
+	}
+
 	cfg, _ := mustLoadCfgAndBadge(*emrsHome)
 
+	if strings.Trim(*removeAction, " ") != "" {
+		executeRemoveAction(cfg, *emrsHome, *removeAction)
+		return
+	}
+
+	if strings.Trim(*updateAction, " ") != "" {
+		if strings.Trim(*actionName, " ") == "" {
+			slog.Error("`--update` requires `--name`")
+			os.Exit(1)
+		}
+		executeUpdateAction(cfg, *emrsHome, *actionName, *updateAction)
+		return
+	}
+
+	if strings.Trim(*disableAction, " ") != "" {
+		executeSetActionEnabled(cfg, *emrsHome, *disableAction, false)
+		return
+	}
+
+	if strings.Trim(*enableAction, " ") != "" {
+		executeSetActionEnabled(cfg, *emrsHome, *enableAction, true)
+		return
+	}
+
 	if strings.Trim(*createAction, " ") != "" {
 		if strings.Trim(*actionName, " ") == "" {
 			slog.Error("`--new-action` requires `--name`")
@@ -391,6 +614,11 @@ func cliAction() {
 		executeCreateAction(cfg, *emrsHome, *actionName, *createAction)
 		return
 	}
+
+	if strings.Trim(*createLibrary, " ") != "" {
+		executeCreateLibrary(cfg, *emrsHome, *actionName, *createLibrary)
+		return
+	}
 }
 
 func cliTokens() {
@@ -420,6 +648,10 @@ func cliSubmit() {
 	submitCmd := flag.NewFlagSet("submit", flag.ExitOnError)
 	emrsUrl := submitCmd.String("to", "", "EMRS Url to submit do")
 	data := submitCmd.String("data", "", "Data to send along")
+	tags := submitCmd.String("tags", "", "Comma separated tags to send along (ex: temp,outdoor)")
+	retries := submitCmd.Int("retries", 0, "Times to retry the submission if the server can't take it")
+	contentType := submitCmd.String("type", "", "Content type of the data (ex: application/json)")
+	compressed := submitCmd.Bool("gzip", false, "Compress the data before sending it")
 	emrsHome := submitCmd.String("home", "", "Home directory")
 
 	submitCmd.Parse(os.Args[2:])
@@ -431,14 +663,25 @@ func cliSubmit() {
 		os.Exit(1)
 	}
 
+	tagList, err := api.DecomposeTags(*tags)
+	if err != nil {
+		slog.Error("invalid tags given", "tags", *tags, "error", err.Error())
+		os.Exit(1)
+	}
+
 	cfg, badge := mustLoadCfgAndBadge(*emrsHome)
 
-	executeSubmission(badge, cfg, *emrsUrl, *data)
+	executeSubmission(badge, cfg, *emrsUrl, *data, tagList, api.Options{
+		Retries:     *retries,
+		ContentType: *contentType,
+		Gzip:        *compressed,
+	})
 }
 
 func cliCnc() {
 	cncCmd := flag.NewFlagSet("cnc", flag.ExitOnError)
 	down := cncCmd.Bool("down", false, "Shutdown local server")
+	reloadActions := cncCmd.Bool("reload-actions", false, "Reload changed actions on the local server")
 	updateUiKey := cncCmd.Bool("change-ui-key", false, "Change out the UI Key")
 	emrsHome := cncCmd.String("home", "", "Home directory")
 
@@ -452,23 +695,7 @@ func cliCnc() {
 		os.Exit(1)
 	}
 
-	o, e := dataStrj.GetOwner()
-	if e != nil {
-		slog.Error("failed to retrieve owner for auth", "error", e.Error())
-		os.Exit(1)
-	}
-
-	{
-		userInput := mustGetPassword()
-
-		println("\r\n")
-
-		if err := badger.RawIsHashMatch(userInput, []byte(o.Hash)); err != nil {
-			slog.Error("authentication error", "error", err.Error())
-			os.Exit(7)
-		}
-		slog.Info("authentication complete")
-	}
+	mustAuthenticateOwner(dataStrj)
 
 	if *down {
 		slog.Debug("shutdown request")
@@ -477,6 +704,12 @@ func cliCnc() {
 		return
 	}
 
+	if *reloadActions {
+		cfg, badge := mustLoadCfgAndBadge(*emrsHome)
+		executeReloadActions(cfg, badge, dataStrj)
+		return
+	}
+
 	if *updateUiKey {
 
 		_, badge := mustLoadCfgAndBadge(*emrsHome)
@@ -573,8 +806,9 @@ func generateVouchers(badge badger.Badge, n int, durr time.Duration) {
 // (30 sec) for each request. Whats important to realize is that we
 // are using the local server's identity, meaning that this will
 // only be valid for the local EMRS instance, and not any others
-// unless they share the same identity
-func executeSubmission(badge badger.Badge, cfg Config, url string, data string) {
+// unless they share the same identity. The binding, asset and
+// token of `opts` are filled in from the url and the badge
+func executeSubmission(badge badger.Badge, cfg Config, url string, data string, tags []string, opts api.Options) {
 
 	slog.Debug("submission execution request", "url", url, "data", data)
 
@@ -606,20 +840,20 @@ func executeSubmission(badge badger.Badge, cfg Config, url string, data string)
 		info.Key = cfg.Key
 	}
 
-	client := api.HttpSubmissions(api.Options{
-		Binding:     emrsUrl.Server,
-		AssetId:     emrsUrl.Asset,
-		AccessToken: voucher,
-	},
-		info,
-	)
+	opts.Binding = emrsUrl.Server
+	opts.AssetId = emrsUrl.Asset
+	opts.AccessToken = voucher
+
+	client := api.HttpSubmissions(opts, info)
 
 	composed, _ := api.ComposeRoute(emrsUrl.Route)
 
-	if e := client.Submit(composed, []byte(data)); e != nil {
+	id, e := client.SubmitTagged(composed, tags, []byte(data))
+	if e != nil {
 		fmt.Println("Error from HTTP Client:", e.Error())
 		os.Exit(1)
 	}
+	fmt.Println("job:", id)
 	return
 }
 
@@ -639,14 +873,15 @@ func executeGetStatus(binding string, cfg Config) {
 		info,
 	)
 
-	ut, err := client.GetUptime()
+	stats, err := client.GetStats()
 
 	if err != nil {
 		slog.Error("error fetching server getStatus", "binding", binding, "error", err.Error)
 		os.Exit(1)
 	}
 
-	fmt.Println("server is up. uptime:", ut.String())
+	fmt.Println("server is up. uptime:", stats.Uptime.String())
+	fmt.Println("throttled submissions:", stats.Throttled)
 }
 
 func executeDown(cfg Config, badge badger.Badge, db datastore.DataStore) {
@@ -655,6 +890,70 @@ func executeDown(cfg Config, badge badger.Badge, db datastore.DataStore) {
 	//        apis expand we should restructure this main application to route the commands
 	//        to a specific api handler that is constructed once for all of the different commands
 
+	client := mustBuildCncClient(cfg, badge, db)
+
+	if err := client.Shutdown(); err != nil {
+		slog.Info("failed to request shutdown on server", "error", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println("complete")
+}
+
+func executeReloadActions(cfg Config, badge badger.Badge, db datastore.DataStore) {
+
+	client := mustBuildCncClient(cfg, badge, db)
+
+	reloaded, err := client.ReloadActions()
+	if err != nil {
+		slog.Error("failed to reload actions on server", "error", err.Error())
+		os.Exit(1)
+	}
+
+	if len(reloaded) == 0 {
+		fmt.Println("no actions changed")
+		return
+	}
+	fmt.Println("reloaded:", strings.Join(reloaded, ", "))
+}
+
+func executeActionLogs(home string, action string, follow bool) {
+
+	dataStrj, err := datastore.Load(filepath.Join(home, defaultStoragePath))
+	if err != nil {
+		slog.Error("failed to load datastore", "error", err.Error())
+		os.Exit(1)
+	}
+
+	mustAuthenticateOwner(dataStrj)
+
+	cfg, badge := mustLoadCfgAndBadge(home)
+
+	client := mustBuildCncClient(cfg, badge, dataStrj)
+
+	var last int64
+	for {
+		lines, err := client.ActionOutput(action, last)
+		if err != nil {
+			slog.Error("failed to retrieve action output", "action", action, "error", err.Error())
+			os.Exit(1)
+		}
+
+		for _, line := range lines {
+			fmt.Printf("%s [%s] %s\n", line.Time.Format(time.RFC3339), line.Stream, line.Text)
+			last = line.Seq
+		}
+
+		if !follow {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Build a CNC api for the local server using the owner's UI key
+func mustBuildCncClient(cfg Config, badge badger.Badge, db datastore.DataStore) api.CNCApi {
+
 	var info *api.HttpsInfo
 
 	if strings.Trim(cfg.Key, " ") != "" && strings.Trim(cfg.Cert, " ") != "" {
@@ -674,33 +973,84 @@ func executeDown(cfg Config, badge badger.Badge, db datastore.DataStore) {
 		os.Exit(2)
 	}
 
-	client := api.HttpCNC(cfg.Binding, o.UiKey, info)
+	return api.HttpCNC(cfg.Binding, o.UiKey, info)
+}
+
+// Libraries are installed next to actions but are not actions themselves,
+// they are only loaded when an action imports them
+func executeCreateLibrary(cfg Config, home string, name string, location string) {
 
-	if err := client.Shutdown(); err != nil {
-		slog.Info("failed to request shutdown on server", "error", err.Error())
+	info, err := os.Stat(location)
+	if err != nil || !info.IsDir() {
+		slog.Error("libraries must be package directories", "source", location)
 		os.Exit(1)
 	}
 
-	fmt.Println("complete")
+	if _, isModule, _ := readModulePath(location); !isModule && strings.Trim(name, " ") == "" {
+		slog.Error("`--lib` requires `--name` when the library is not a module")
+		os.Exit(1)
+	}
+
+	destination, err := installSource(home, name, location, cfg.Actions)
+	if err != nil {
+		slog.Error("failed to install library", "source", location, "destination", destination, "error", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("installed:", destination)
+}
+
+// Tests do not need a server, but if a home is known the
+// actions there can be imported by the action under test
+func executeTestAction(home string, location string, run string, verbose bool) {
+	if home == "" {
+		home = os.Getenv(defaultEnvHome)
+	}
+
+	opts := emrstest.Options{
+		Run:     run,
+		Verbose: verbose,
+	}
+	if home != "" {
+		opts.GoPath = filepath.Join(home, defaultActionsDir)
+	}
+
+	// Exits with the test result once the tests are loaded
+	if err := emrstest.RunTests(location, opts); err != nil {
+		slog.Error("failed to run action tests", "source", location, "error", err.Error())
+		os.Exit(1)
+	}
 }
 
 func executeCreateAction(cfg Config, home string, name string, location string) {
-	actionsDir := filepath.Join(home, defaultActionsDir)
-	targetName := filepath.Base(location)
-	destination := filepath.Join(actionsDir, targetName)
 
-	slog.Debug("create action", "home", home, "name", name, "source", location, "destination", destination)
+	slog.Debug("create action", "home", home, "name", name, "source", location)
+
+	if _, exists := cfg.Actions[name]; exists {
+		slog.Error("an action with that name is already installed, use `--update` to replace it", "name", name)
+		os.Exit(1)
+	}
+
+	// Nothing is installed unless the action would load on the server
+	mustValidateAction(home, name, location, cfg.Capabilities[name])
 
-	size, err := copyFile(location, destination)
+	destination, err := installSource(home, name, location, cfg.Actions)
 	if err != nil {
-		slog.Error("failed to copy target file", "source", location, "destination", destination, "error", err.Error())
+		slog.Error("failed to install action", "source", location, "destination", destination, "error", err.Error())
 		os.Exit(1)
 	}
-	slog.Debug("copy success", "K", size)
+	slog.Debug("install success", "destination", destination)
 
 	// Now we add it to config
+	if cfg.Actions == nil {
+		cfg.Actions = make(map[string]string)
+	}
 	cfg.Actions[name] = destination
 
+	mustWriteConfig(home, cfg)
+}
+
+func mustWriteConfig(home string, cfg Config) {
+
 	b, e := yaml.Marshal(&cfg)
 	if e != nil {
 		slog.Error("Failed to encode new config", "error", e.Error())
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bosley/emrs/api"
+	"github.com/bosley/emrs/datastore"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+func executeListRateLimits(db datastore.DataStore) {
+
+	found := false
+	for _, asset := range db.GetAssets() {
+		limits, err := db.GetRateLimits(asset.Id)
+		if err != nil {
+			slog.Error("failed to retrieve rate limits", "asset", asset.Id, "error", err.Error())
+			os.Exit(1)
+		}
+		for _, limit := range limits {
+			route := limit.Route
+			if route == "" {
+				route = "(all routes)"
+			}
+			fmt.Printf("%s | %s | %s | %g/s | burst %d\n", asset.Id, asset.DisplayName, route, limit.Rate, limit.Burst)
+			found = true
+		}
+	}
+
+	if !found {
+		fmt.Println("There are no rate limits set for assets")
+	}
+}
+
+func executeSetRateLimit(db datastore.DataStore, asset string, route string, rate float64, burst int) {
+
+	if rate < 0 {
+		slog.Error("fail. --limit requires --rate")
+		os.Exit(1)
+	}
+
+	if burst < 0 {
+		slog.Error("invalid burst", "burst", burst)
+		os.Exit(1)
+	}
+
+	limit := datastore.RateLimit{
+		Asset: mustFindAsset(db, asset),
+		Route: mustValidateLimitRoute(route),
+		Rate:  rate,
+		Burst: burst,
+	}
+
+	if err := db.SetRateLimit(limit); err != nil {
+		slog.Error("failed to set rate limit", "error", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("limit set:", limit.Asset)
+}
+
+func executeRemoveRateLimit(db datastore.DataStore, asset string, route string) {
+
+	id := mustFindAsset(db, asset)
+
+	if err := db.RemoveRateLimit(id, mustValidateLimitRoute(route)); err != nil {
+		slog.Error("failed to remove rate limit", "error", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("limit removed:", id)
+}
+
+// Asset ids or names, as with `events --asset`, but the asset must exist
+func mustFindAsset(db datastore.DataStore, given string) string {
+	id := assetIdFromName(db, strings.TrimSpace(given))
+	if !db.AssetExists(id) {
+		slog.Error("no asset with that id or name", "asset", given)
+		os.Exit(1)
+	}
+	return id
+}
+
+func mustValidateLimitRoute(route string) string {
+	route = strings.TrimSpace(route)
+	if route == "" {
+		return route
+	}
+	if _, err := api.DecomposeRoute(route); err != nil {
+		slog.Error("invalid route", "route", route, "error", err.Error())
+		os.Exit(1)
+	}
+	return route
+}
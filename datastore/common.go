@@ -2,6 +2,7 @@ package datastore
 
 import (
 	"database/sql"
+	"fmt"
 	_ "modernc.org/sqlite"
 )
 
@@ -33,7 +34,128 @@ const assets_update = `update assets set uuid = ?, name = ? where uuid = ?`
 const assets_delete = `delete from assets where uuid = ?`
 const assets_fetch = `select uuid, name from assets`
 
+const db_table_create_jobs = `create table jobs (
+  id integer not null primary key,
+  uuid text,
+  origin text,
+  route text,
+  data blob,
+  created integer,
+  UNIQUE(uuid)
+)`
+
+const jobs_create = `insert into jobs (id, uuid, origin, route, data, created, received, headers, version, tags, event) values (NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+const jobs_delete = `delete from jobs where uuid = ?`
+const jobs_fetch = `select uuid, origin, route, data, created, attempts, received, headers, version, tags, event from jobs order by id`
+const jobs_update_attempts = `update jobs set attempts = ? where uuid = ?`
+
+const db_table_create_deadletters = `create table deadletters (
+  id integer not null primary key,
+  uuid text,
+  origin text,
+  route text,
+  data blob,
+  attempts integer,
+  error text,
+  failed integer,
+  UNIQUE(uuid)
+)`
+
+const deadletters_create = `insert or replace into deadletters (id, uuid, origin, route, data, attempts, error, failed, received, headers, version, tags, event) values (NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+const deadletters_get = `select uuid, origin, route, data, attempts, error, failed, received, headers, version, tags, event from deadletters where uuid = ?`
+const deadletters_delete = `delete from deadletters where uuid = ?`
+const deadletters_purge = `delete from deadletters`
+const deadletters_fetch = `select uuid, origin, route, data, attempts, error, failed, received, headers, version, tags, event from deadletters order by id`
+
+const db_table_create_actionstate = `create table actionstate (
+  id integer not null primary key,
+  action text,
+  key text,
+  value blob,
+  UNIQUE(action, key)
+)`
+
+const actionstate_set = `insert or replace into actionstate (id, action, key, value) values (NULL, ?, ?, ?)`
+const actionstate_get = `select value from actionstate where action = ? and key = ?`
+const actionstate_delete = `delete from actionstate where action = ? and key = ?`
+const actionstate_keys = `select key from actionstate where action = ? and substr(key, 1, length(?)) = ? order by key`
+
+const db_table_create_events = `create table events (
+  id integer not null primary key,
+  uuid text,
+  origin text,
+  route text,
+  size integer,
+  payload blob,
+  received integer,
+  jobs integer,
+  completed integer not null default 0,
+  failed integer not null default 0,
+  outcome text,
+  error text not null default '',
+  UNIQUE(uuid)
+)`
+
+const events_create = `insert into events (id, uuid, origin, route, size, payload, received, jobs, outcome, headers, version, tags) values (NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// The outcome is settled once every job of the event has completed, and is
+// failed if any of them failed. Expressions see the values before the update
+const events_complete_job = `update events set
+  completed = completed + 1,
+  failed = failed + ?2,
+  error = case when ?3 != '' then ?3 else error end,
+  outcome = case
+    when completed + 1 < jobs then ?4
+    when failed + ?2 > 0 then ?5
+    else ?6 end
+  where uuid = ?1`
+
+// The error is taken from another of the event's dead letters if any job
+// still failed, as the one being retried may have been the one recorded
+const events_reopen_job = `update events set
+  completed = max(completed - 1, 0),
+  failed = max(failed - 1, 0),
+  error = case
+    when failed > 1 then coalesce((select d.error from deadletters d where d.event = ?1 order by d.failed desc limit 1), error)
+    else '' end,
+  outcome = ?2
+  where uuid = ?1`
+
+const events_select = `select uuid, origin, route, size, payload, received, jobs, outcome, error, headers, version, tags from events`
+
+const db_table_create_idempotency = `create table idempotency (
+  id integer not null primary key,
+  origin text,
+  key text,
+  created integer,
+  event text not null default '',
+  jobs text not null default '',
+  UNIQUE(origin, key)
+)`
+
+const idempotency_expire = `delete from idempotency where created < ?`
+const idempotency_abandon = `delete from idempotency where jobs = '' and created < ?`
+const idempotency_claim = `insert or ignore into idempotency (id, origin, key, created) values (NULL, ?, ?, ?)`
+const idempotency_get = `select origin, key, created, event, jobs, missing from idempotency where origin = ? and key = ?`
+const idempotency_complete = `update idempotency set event = ?, jobs = ?, missing = ?, resumed = 0 where origin = ? and key = ?`
+const idempotency_resume = `update idempotency set resumed = ? where origin = ? and key = ? and missing != '' and missing = ? and resumed < ?`
+const idempotency_release = `delete from idempotency where origin = ? and key = ?`
+
+const db_table_create_ratelimits = `create table ratelimits (
+  id integer not null primary key,
+  asset text,
+  route text,
+  rate real,
+  burst integer,
+  UNIQUE(asset, route)
+)`
+
+const ratelimits_set = `insert or replace into ratelimits (id, asset, route, rate, burst) values (NULL, ?, ?, ?, ?)`
+const ratelimits_delete = `delete from ratelimits where asset = ? and route = ?`
+const ratelimits_fetch = `select asset, route, rate, burst from ratelimits where asset = ? order by route`
+
 const db_contains_table = `select name from sqlite_master where type = 'table' and name = ?`
+const db_contains_column = `select name from pragma_table_info(?) where name = ?`
 
 func db_does_table_exist(db *sql.DB, table string) (bool, error) {
 	stmt, err := db.Prepare(db_contains_table)
@@ -63,3 +185,19 @@ func db_ensure_table_exists(db *sql.DB, table string, creation_stmt string) erro
 	}
 	return nil
 }
+
+// Columns added to tables after their initial release are not part of the
+// statements above. They are added in place, to new and older datastores
+// alike, from the list in newController
+func db_ensure_column_exists(db *sql.DB, table string, column string, definition string) error {
+	var name string
+	err := db.QueryRow(db_contains_column, table, column).Scan(&name)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+	return err
+}
@@ -2,12 +2,16 @@ package datastore
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	_ "modernc.org/sqlite"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -37,7 +41,9 @@ func newController(path string) (*controller, error) {
 
 	c.running.Store(false)
 
-	const options = "?_journal_mode=WAL"
+	// Jobs run concurrently, so connections wait on one
+	// another rather than failing with SQLITE_BUSY
+	const options = "?_journal_mode=WAL&_pragma=busy_timeout(5000)"
 	db, err := sql.Open("sqlite", fmt.Sprintf("%s%s", path, options))
 	if err != nil {
 		return nil, err
@@ -54,6 +60,12 @@ func newController(path string) (*controller, error) {
 	for _, table := range []tcs{
 		tcs{"users", db_table_create_users},
 		tcs{"assets", db_table_create_assets},
+		tcs{"jobs", db_table_create_jobs},
+		tcs{"deadletters", db_table_create_deadletters},
+		tcs{"actionstate", db_table_create_actionstate},
+		tcs{"events", db_table_create_events},
+		tcs{"idempotency", db_table_create_idempotency},
+		tcs{"ratelimits", db_table_create_ratelimits},
 	} {
 
 		if err := db_ensure_table_exists(c.db, table.name, table.stmt); err != nil {
@@ -62,6 +74,38 @@ func newController(path string) (*controller, error) {
 			return nil, err
 		}
 	}
+
+	type ccs struct {
+		table      string
+		column     string
+		definition string
+	}
+
+	for _, column := range []ccs{
+		ccs{"jobs", "attempts", "integer not null default 0"},
+		ccs{"jobs", "received", "integer not null default 0"},
+		ccs{"jobs", "headers", "text not null default ''"},
+		ccs{"jobs", "version", "text not null default ''"},
+		ccs{"jobs", "tags", "text not null default ''"},
+		ccs{"deadletters", "received", "integer not null default 0"},
+		ccs{"deadletters", "headers", "text not null default ''"},
+		ccs{"deadletters", "version", "text not null default ''"},
+		ccs{"deadletters", "tags", "text not null default ''"},
+		ccs{"jobs", "event", "text not null default ''"},
+		ccs{"deadletters", "event", "text not null default ''"},
+		ccs{"events", "headers", "text not null default ''"},
+		ccs{"events", "version", "text not null default ''"},
+		ccs{"events", "tags", "text not null default ''"},
+		ccs{"idempotency", "missing", "text not null default ''"},
+		ccs{"idempotency", "resumed", "integer not null default 0"},
+	} {
+
+		if err := db_ensure_column_exists(c.db, column.table, column.column, column.definition); err != nil {
+			slog.Error("error setting up column", "table", column.table, "column", column.column)
+			c.db.Close()
+			return nil, err
+		}
+	}
 	return &c, nil
 }
 
@@ -112,6 +156,18 @@ func (c *controller) AssetExists(id string) bool {
 	return false
 }
 
+func (c *controller) GetAsset(id string) (Asset, error) {
+	var asset Asset
+	err := c.db.QueryRow(assets_get, id).Scan(&asset.Id, &asset.DisplayName)
+	if err == sql.ErrNoRows {
+		return Asset{}, ErrNotFound
+	}
+	if err != nil {
+		return Asset{}, err
+	}
+	return asset, nil
+}
+
 func (c *controller) AddAsset(asset Asset) bool {
 	if c.AssetExists(asset.DisplayName) {
 		slog.Error("asset already exists")
@@ -260,6 +316,508 @@ func (c *controller) UpdateOwner(owner User) bool {
 	return true
 }
 
+func (c *controller) AddJob(job Job) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		slog.Error("failed to create tx", "err", err.Error())
+		return err
+	}
+	stmt, err := tx.Prepare(jobs_create)
+	if err != nil {
+		slog.Error("error preparing job-create", "err", err.Error())
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(
+		job.Id,
+		job.Origin,
+		job.Route,
+		job.Data,
+		job.Created.UnixNano(),
+		job.Received.UnixNano(),
+		encodeHeaders(job.Headers),
+		job.Version,
+		encodeTags(job.Tags),
+		job.Event,
+	)
+	if err != nil {
+		slog.Error("error storing job", "id", job.Id, "err", err.Error())
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error tx commit", "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) RemoveJob(id string) error {
+	slog.Debug("deleting job", "id", id)
+	_, err := c.db.Exec(jobs_delete, id)
+	if err != nil {
+		slog.Error("error deleting job", "id", id, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) UpdateJobAttempts(id string, attempts int) error {
+	_, err := c.db.Exec(jobs_update_attempts, attempts, id)
+	if err != nil {
+		slog.Error("error updating job attempts", "id", id, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) GetJobs() []Job {
+	slog.Debug("retrieve jobs")
+	result := make([]Job, 0)
+	rows, err := c.db.Query(jobs_fetch)
+	if err != nil {
+		slog.Error(err.Error())
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry Job
+		var created, received int64
+		var headers, tags string
+		err = rows.Scan(&entry.Id, &entry.Origin, &entry.Route, &entry.Data, &created, &entry.Attempts, &received, &headers, &entry.Version, &tags, &entry.Event)
+		if err != nil {
+			slog.Error(err.Error())
+			return make([]Job, 0)
+		}
+		entry.Created = time.Unix(0, created)
+		entry.Received = time.Unix(0, received)
+		entry.Headers = decodeHeaders(headers)
+		entry.Tags = decodeTags(tags)
+		result = append(result, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		slog.Error(err.Error())
+		return make([]Job, 0)
+	}
+	return result
+}
+
+func (c *controller) AddDeadLetter(letter DeadLetter) error {
+	_, err := c.db.Exec(
+		deadletters_create,
+		letter.Id,
+		letter.Origin,
+		letter.Route,
+		letter.Data,
+		letter.Attempts,
+		letter.Error,
+		letter.Failed.UnixNano(),
+		letter.Received.UnixNano(),
+		encodeHeaders(letter.Headers),
+		letter.Version,
+		encodeTags(letter.Tags),
+		letter.Event)
+	if err != nil {
+		slog.Error("error storing dead letter", "id", letter.Id, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) GetDeadLetter(id string) (DeadLetter, error) {
+	return scanDeadLetter(c.db.QueryRow(deadletters_get, id))
+}
+
+func (c *controller) GetDeadLetters() []DeadLetter {
+	slog.Debug("retrieve dead letters")
+	result := make([]DeadLetter, 0)
+	rows, err := c.db.Query(deadletters_fetch)
+	if err != nil {
+		slog.Error(err.Error())
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry, err := scanDeadLetter(rows)
+		if err != nil {
+			slog.Error(err.Error())
+			return make([]DeadLetter, 0)
+		}
+		result = append(result, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		slog.Error(err.Error())
+		return make([]DeadLetter, 0)
+	}
+	return result
+}
+
+func scanDeadLetter(row interface{ Scan(...any) error }) (DeadLetter, error) {
+	var letter DeadLetter
+	var failed, received int64
+	var headers, tags string
+	err := row.Scan(
+		&letter.Id,
+		&letter.Origin,
+		&letter.Route,
+		&letter.Data,
+		&letter.Attempts,
+		&letter.Error,
+		&failed,
+		&received,
+		&headers,
+		&letter.Version,
+		&tags,
+		&letter.Event)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	letter.Failed = time.Unix(0, failed)
+	letter.Received = time.Unix(0, received)
+	letter.Headers = decodeHeaders(headers)
+	letter.Tags = decodeTags(tags)
+	return letter, nil
+}
+
+func (c *controller) RemoveDeadLetter(id string) error {
+	_, err := c.db.Exec(deadletters_delete, id)
+	if err != nil {
+		slog.Error("error deleting dead letter", "id", id, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) PurgeDeadLetters() error {
+	_, err := c.db.Exec(deadletters_purge)
+	if err != nil {
+		slog.Error("error purging dead letters", "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) GetActionValue(action string, key string) ([]byte, error) {
+	var value []byte
+	err := c.db.QueryRow(actionstate_get, action, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error retrieving action value", "action", action, "key", key, "err", err.Error())
+		return nil, err
+	}
+	return value, nil
+}
+
+func (c *controller) SetActionValue(action string, key string, value []byte) error {
+	_, err := c.db.Exec(actionstate_set, action, key, value)
+	if err != nil {
+		slog.Error("error storing action value", "action", action, "key", key, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) DeleteActionValue(action string, key string) error {
+	_, err := c.db.Exec(actionstate_delete, action, key)
+	if err != nil {
+		slog.Error("error deleting action value", "action", action, "key", key, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) GetActionKeys(action string, prefix string) ([]string, error) {
+	rows, err := c.db.Query(actionstate_keys, action, prefix, prefix)
+	if err != nil {
+		slog.Error("error retrieving action keys", "action", action, "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		result = append(result, key)
+	}
+	return result, rows.Err()
+}
+
+func (c *controller) AddEvent(event Event) error {
+	_, err := c.db.Exec(
+		events_create,
+		event.Id,
+		event.Origin,
+		event.Route,
+		event.Size,
+		event.Payload,
+		event.Received.UnixNano(),
+		event.Jobs,
+		EventPending,
+		encodeHeaders(event.Headers),
+		event.Version,
+		encodeTags(event.Tags))
+	if err != nil {
+		slog.Error("error storing event", "id", event.Id, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Record the result of one of the event's jobs. An empty error is a success
+func (c *controller) CompleteEventJob(id string, jobErr string) error {
+	failed := 0
+	if jobErr != "" {
+		failed = 1
+	}
+	_, err := c.db.Exec(events_complete_job, id, failed, jobErr, EventPending, EventFailed, EventSucceeded)
+	if err != nil {
+		slog.Error("error updating event", "id", id, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Take back the failed result of one of the event's jobs, as it is being retried
+func (c *controller) ReopenEventJob(id string) error {
+	_, err := c.db.Exec(events_reopen_job, id, EventPending)
+	if err != nil {
+		slog.Error("error updating event", "id", id, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) GetEvents(filter EventFilter) ([]Event, error) {
+
+	conditions := make([]string, 0)
+	args := make([]any, 0)
+
+	if filter.Origin != "" {
+		conditions = append(conditions, "origin = ?")
+		args = append(args, filter.Origin)
+	}
+	if filter.RoutePrefix != "" {
+		conditions = append(conditions, "(route = ? or substr(route, 1, length(?) + 1) = ? || '.')")
+		args = append(args, filter.RoutePrefix, filter.RoutePrefix, filter.RoutePrefix)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "received >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "received <= ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	if filter.Outcome != "" {
+		conditions = append(conditions, "outcome = ?")
+		args = append(args, filter.Outcome)
+	}
+
+	query := events_select
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	query += " order by id desc"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" limit %d", filter.Limit)
+	}
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		slog.Error("error retrieving events", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]Event, 0)
+	for rows.Next() {
+		var event Event
+		var received int64
+		var headers, tags string
+		err := rows.Scan(
+			&event.Id,
+			&event.Origin,
+			&event.Route,
+			&event.Size,
+			&event.Payload,
+			&received,
+			&event.Jobs,
+			&event.Outcome,
+			&event.Error,
+			&headers,
+			&event.Version,
+			&tags)
+		if err != nil {
+			return nil, err
+		}
+		event.Received = time.Unix(0, received)
+		event.Headers = decodeHeaders(headers)
+		event.Tags = decodeTags(tags)
+		result = append(result, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Retrieved newest first so that the limit keeps the most recent
+	slices.Reverse(result)
+	return result, nil
+}
+
+func (c *controller) ClaimIdempotencyKey(key IdempotencyKey, expired time.Time, abandoned time.Time) (IdempotencyKey, bool, error) {
+
+	if _, err := c.db.Exec(idempotency_expire, expired.UnixNano()); err != nil {
+		slog.Error("error expiring idempotency keys", "err", err.Error())
+		return key, false, err
+	}
+
+	if _, err := c.db.Exec(idempotency_abandon, abandoned.UnixNano()); err != nil {
+		slog.Error("error releasing abandoned idempotency keys", "err", err.Error())
+		return key, false, err
+	}
+
+	result, err := c.db.Exec(idempotency_claim, key.Origin, key.Key, key.Created.UnixNano())
+	if err != nil {
+		slog.Error("error claiming idempotency key", "origin", key.Origin, "err", err.Error())
+		return key, false, err
+	}
+
+	if claimed, err := result.RowsAffected(); err == nil && claimed == 1 {
+		return key, true, nil
+	}
+
+	var created int64
+	var jobs, missing string
+	existing := IdempotencyKey{}
+	err = c.db.QueryRow(idempotency_get, key.Origin, key.Key).Scan(
+		&existing.Origin,
+		&existing.Key,
+		&created,
+		&existing.Event,
+		&jobs,
+		&missing)
+	if err != nil {
+		slog.Error("error retrieving idempotency key", "origin", key.Origin, "err", err.Error())
+		return key, false, err
+	}
+	existing.Created = time.Unix(0, created)
+	existing.Jobs = decodeTags(jobs)
+	existing.Missing = decodeTags(missing)
+	return existing, false, nil
+}
+
+func (c *controller) CompleteIdempotencyKey(key IdempotencyKey) error {
+	_, err := c.db.Exec(idempotency_complete, key.Event, encodeTags(key.Jobs), encodeTags(key.Missing), key.Origin, key.Key)
+	if err != nil {
+		slog.Error("error updating idempotency key", "origin", key.Origin, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) ResumeIdempotencyKey(key IdempotencyKey, now time.Time, abandoned time.Time) (bool, error) {
+	result, err := c.db.Exec(idempotency_resume, now.UnixNano(), key.Origin, key.Key, encodeTags(key.Missing), abandoned.UnixNano())
+	if err != nil {
+		slog.Error("error resuming idempotency key", "origin", key.Origin, "err", err.Error())
+		return false, err
+	}
+	resumed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return resumed == 1, nil
+}
+
+func (c *controller) ReleaseIdempotencyKey(origin string, key string) error {
+	_, err := c.db.Exec(idempotency_release, origin, key)
+	if err != nil {
+		slog.Error("error releasing idempotency key", "origin", origin, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) SetRateLimit(limit RateLimit) error {
+	_, err := c.db.Exec(ratelimits_set, limit.Asset, limit.Route, limit.Rate, limit.Burst)
+	if err != nil {
+		slog.Error("error storing rate limit", "asset", limit.Asset, "route", limit.Route, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) RemoveRateLimit(asset string, route string) error {
+	_, err := c.db.Exec(ratelimits_delete, asset, route)
+	if err != nil {
+		slog.Error("error removing rate limit", "asset", asset, "route", route, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *controller) GetRateLimits(asset string) ([]RateLimit, error) {
+	rows, err := c.db.Query(ratelimits_fetch, asset)
+	if err != nil {
+		slog.Error("error retrieving rate limits", "asset", asset, "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]RateLimit, 0)
+	for rows.Next() {
+		var limit RateLimit
+		if err := rows.Scan(&limit.Asset, &limit.Route, &limit.Rate, &limit.Burst); err != nil {
+			return nil, err
+		}
+		result = append(result, limit)
+	}
+	return result, rows.Err()
+}
+
+// Headers are kept as a json object
+func encodeHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		slog.Error("failed to encode headers", "err", err.Error())
+		return ""
+	}
+	return string(encoded)
+}
+
+func decodeHeaders(encoded string) map[string]string {
+	headers := make(map[string]string)
+	if encoded == "" {
+		return headers
+	}
+	if err := json.Unmarshal([]byte(encoded), &headers); err != nil {
+		slog.Error("failed to decode headers", "err", err.Error())
+	}
+	return headers
+}
+
+// Tags are validated as route chunks before they reach
+// the datastore, so they are kept as a ',' separated list
+func encodeTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+func decodeTags(encoded string) []string {
+	if encoded == "" {
+		return []string{}
+	}
+	return strings.Split(encoded, ",")
+}
+
 // --
 
 func (c *controller) retrieveUser(username string) *User {
@@ -1,13 +1,21 @@
 package datastore
 
 import (
+	"errors"
 	"log/slog"
 	"os"
+	"time"
 )
 
 const (
 	usersDb = "users"
 	assetDb = "assets"
+	jobsDb  = "jobs"
+	deadDb  = "deadletters"
+	stateDb = "actionstate"
+	eventDb = "events"
+	idemDb  = "idempotency"
+	rateDb  = "ratelimits"
 )
 
 const (
@@ -16,17 +24,65 @@ const (
 	RingTwo          // Optional for later addition of non-owner users
 )
 
+var ErrNotFound = errors.New("not found")
+
 type DataStore interface {
 	AddAsset(asset Asset) bool
 	GetAssets() []Asset
 	UpdateAsset(asset Asset) bool
 	RemoveAsset(id string) bool
 	AssetExists(id string) bool
+	GetAsset(id string) (Asset, error)
 
 	GetOwner() (User, error)
 	UpdateOwner(owner User) bool
 	UpdateOwnerUiKey(key string) bool
 
+	AddJob(job Job) error
+	RemoveJob(id string) error
+	UpdateJobAttempts(id string, attempts int) error
+	GetJobs() []Job
+
+	AddDeadLetter(letter DeadLetter) error
+	GetDeadLetter(id string) (DeadLetter, error)
+	GetDeadLetters() []DeadLetter
+	RemoveDeadLetter(id string) error
+	PurgeDeadLetters() error
+
+	// Values kept by actions, each action has its own set of keys
+	GetActionValue(action string, key string) ([]byte, error)
+	SetActionValue(action string, key string, value []byte) error
+	DeleteActionValue(action string, key string) error
+	GetActionKeys(action string, prefix string) ([]string, error)
+
+	// The history of accepted events. Each job created for an event
+	// reports its result once, when it succeeds or is dead lettered
+	AddEvent(event Event) error
+	CompleteEventJob(id string, jobErr string) error
+	ReopenEventJob(id string) error
+	GetEvents(filter EventFilter) ([]Event, error)
+
+	// Keys given by assets so that repeats of a submission are recognized.
+	// Claiming a key forgets every key created before `expired`, and every
+	// claim made before `abandoned` that was never completed, then either
+	// claims the key (true) or returns the submission that claimed it first
+	ClaimIdempotencyKey(key IdempotencyKey, expired time.Time, abandoned time.Time) (IdempotencyKey, bool, error)
+	CompleteIdempotencyKey(key IdempotencyKey) error
+	ReleaseIdempotencyKey(origin string, key string) error
+
+	// Take over creating the jobs missing from a key's submission, so that
+	// only one repeat of the submission creates them. A repeat that took
+	// them over before `abandoned` without completing the key is given up
+	// on. False is returned if the key is not missing the same jobs, or a
+	// repeat is already creating them
+	ResumeIdempotencyKey(key IdempotencyKey, now time.Time, abandoned time.Time) (bool, error)
+
+	// Submission rate limits set for specific assets, overriding
+	// the limits configured for the server
+	SetRateLimit(limit RateLimit) error
+	RemoveRateLimit(asset string, route string) error
+	GetRateLimits(asset string) ([]RateLimit, error)
+
 	Close()
 }
 
@@ -42,6 +98,95 @@ type Asset struct {
 	DisplayName string
 }
 
+// What is known of how a job came to be, beyond its route and data
+type Submission struct {
+	Received time.Time
+	Headers  map[string]string
+	Version  string
+	Tags     []string
+	Event    string // Id of the event the job was created for, if any
+}
+
+// A job that has been accepted by the server but
+// has not yet finished executing
+type Job struct {
+	Id       string
+	Origin   string
+	Route    string
+	Data     []byte
+	Created  time.Time
+	Attempts int
+
+	Submission
+}
+
+// A job that failed every attempt it was given to
+// execute, kept until it is retried or purged
+type DeadLetter struct {
+	Id       string
+	Origin   string
+	Route    string
+	Data     []byte
+	Attempts int
+	Error    string
+	Failed   time.Time
+
+	Submission
+}
+
+const (
+	EventPending   = "pending"
+	EventSucceeded = "succeeded"
+	EventFailed    = "failed"
+)
+
+// An event accepted from an asset, and what became of it
+type Event struct {
+	Id       string
+	Origin   string
+	Route    string
+	Size     int    // Size of the submitted data
+	Payload  []byte // As much of the data as was kept, if any
+	Received time.Time
+	Headers  map[string]string // As given to the event's jobs
+	Version  string
+	Tags     []string
+	Jobs     int    // Number of jobs created for the event
+	Outcome  string // EventPending, EventSucceeded or EventFailed
+	Error    string // The last error reported by a failed job
+}
+
+// Limits events retrieved to those matching every field that is set.
+// Events are retrieved oldest first
+type EventFilter struct {
+	Origin      string
+	RoutePrefix string // The route, or routes beginning with it (sections)
+	Since       time.Time
+	Until       time.Time
+	Outcome     string
+	Limit       int // Only the most recent, if not zero
+}
+
+// A submission made with an idempotency key. Until the submission has
+// been handed to the runner its event and jobs are empty
+type IdempotencyKey struct {
+	Origin  string
+	Key     string
+	Created time.Time
+	Event   string
+	Jobs    []string
+	Missing []string // Routes of the jobs that could not be submitted yet
+}
+
+// A limit on the rate of an asset's submissions to routes beginning
+// with Route, or to every route if Route is empty
+type RateLimit struct {
+	Asset string
+	Route string
+	Rate  float64 // Submissions per second
+	Burst int
+}
+
 func Load(location string) (DataStore, error) {
 
 	c, err := newController(location)